@@ -25,7 +25,7 @@
           name = "opkssh-policy-plugin-google-workspace";
           version = "0.0.1";
           src = self;
-          vendorHash = "sha256-CtLo/KyrlnNq4z3hEyImouc8wveQtLAiuNYIf+nn9Fw=";
+          vendorHash = "sha256-Qxk9/fqg0pCskhzCfWXBXDONw2oa0nq+QRa2X0lNvpg=";
           subPackages = ["cmd/opkssh-plugin-google-workspace"];
         };
         default = opkssh;
@@ -2,6 +2,7 @@ package opksshplugingoogleworkspacecli
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -20,6 +21,15 @@ const (
 	FlagExpiration = "expiration"
 	FlagVerbose    = "verbose"
 	FlagQuiet      = "quiet"
+	FlagSocket     = "socket"
+
+	FlagPrincipal     = "principal"
+	FlagEmail         = "email"
+	FlagEmailVerified = "email-verified"
+	FlagAudience      = "aud"
+	FlagIssuer        = "iss"
+	FlagHostedDomain  = "hd"
+	FlagSubject       = "sub"
 )
 
 func Main() {
@@ -62,6 +72,12 @@ func Main() {
 					DefaultText: opksshplugingoogleworkspace.DefaultCacheDuration.String(),
 					Value:       opksshplugingoogleworkspace.DefaultCacheDuration,
 				},
+				&cli.StringFlag{
+					Name:        FlagSocket,
+					Usage:       "path to daemon's socket, empty to disable daemon",
+					DefaultText: opksshplugingoogleworkspace.DefaultSocketPath,
+					Value:       opksshplugingoogleworkspace.DefaultSocketPath,
+				},
 				&cli.BoolFlag{
 					Name:        FlagVerbose,
 					Aliases:     []string{"v"},
@@ -114,23 +130,26 @@ func Main() {
 				if logger == nil {
 					panic(logger)
 				}
-				config, err := opksshplugingoogleworkspace.LoadConfig(ctx, logger,
-					c.String(FlagConfig),
-					c.String(FlagCache),
-					c.Duration(FlagExpiration),
-				)
+				request, err := opksshplugingoogleworkspace.LoadRequest(ctx, logger, nil)
 				if err != nil {
 					return err
 				}
 
-				fetcher := opksshplugingoogleworkspace.NewGooglFetcher(config.Google.ServiceAccount)
-				cache := opksshplugingoogleworkspace.NewCacheFetcher(*config.Cache, config.Google.Workspace.CustomerID, fetcher)
-
-				request, err := opksshplugingoogleworkspace.LoadRequest(ctx, logger, nil)
-				if err != nil {
-					return err
+				// ask the daemon first, fallback to in-process verification if the daemon is down
+				var allow bool
+				err = opksshplugingoogleworkspace.ErrDaemonUnavailable
+				if socketPath := c.String(FlagSocket); socketPath != "" {
+					allow, err = opksshplugingoogleworkspace.VerifyDaemon(ctx, logger, socketPath, request)
+				}
+				if errors.Is(err, opksshplugingoogleworkspace.ErrDaemonUnavailable) {
+					var config *opksshplugingoogleworkspace.Config
+					var caches map[string]*opksshplugingoogleworkspace.CacheFetcher
+					config, caches, err = load(ctx, logger, c)
+					if err != nil {
+						return err
+					}
+					allow, err = opksshplugingoogleworkspace.Verify(ctx, logger, fetchers(caches), config, request)
 				}
-				allow, err := opksshplugingoogleworkspace.Verify(ctx, logger, cache, config, request)
 				if err != nil {
 					return err
 				}
@@ -139,6 +158,128 @@ func Main() {
 				}
 				return nil
 			},
+			Commands: []*cli.Command{
+				{
+					Name:        "check",
+					Usage:       "simulate an authorization decision",
+					Description: "Build a request from flags, verify it against the config and cache and explain the decision",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:     FlagPrincipal,
+							Usage:    "principal, system user name to authorize",
+							Required: true,
+						},
+						&cli.StringFlag{
+							Name:     FlagEmail,
+							Usage:    "user's email",
+							Required: true,
+						},
+						&cli.BoolFlag{
+							Name:        FlagEmailVerified,
+							Usage:       "whether the user's email is verified",
+							DefaultText: "true",
+							Value:       true,
+						},
+						&cli.StringFlag{
+							Name:        FlagAudience,
+							Usage:       "audience of the user's token",
+							DefaultText: "client_id from config",
+						},
+						&cli.StringFlag{
+							Name:        FlagIssuer,
+							Usage:       "issuer of the user's token",
+							DefaultText: "allowed issuer from config",
+						},
+						&cli.StringFlag{
+							Name:  FlagSubject,
+							Usage: "immutable Google user ID (sub claim) of the user's token",
+						},
+						&cli.StringFlag{
+							Name:  FlagHostedDomain,
+							Usage: "hosted domain (hd claim) of the user's token, empty for personal accounts",
+						},
+					},
+					Action: func(ctx context.Context, c *cli.Command) error {
+						if logger == nil {
+							panic(logger)
+						}
+						config, caches, err := load(ctx, logger, c)
+						if err != nil {
+							return err
+						}
+
+						request := &opksshplugingoogleworkspace.Request{
+							Principal:     c.String(FlagPrincipal),
+							Email:         c.String(FlagEmail),
+							EmailVerified: c.Bool(FlagEmailVerified),
+							ClientID:      c.String(FlagAudience),
+							Issuer:        c.String(FlagIssuer),
+							Subject:       c.String(FlagSubject),
+						}
+						if !c.IsSet(FlagAudience) {
+							if clientIDs := config.Google.OAuth.AllClientIDs(); len(clientIDs) > 0 {
+								request.ClientID = clientIDs[0]
+							}
+						}
+						if !c.IsSet(FlagIssuer) {
+							request.Issuer = opksshplugingoogleworkspace.DefaultIssuer
+							if tenant, ok := config.TenantByClientID(request.ClientID); ok {
+								request.Issuer = tenant.OAuth.AllowedIssuers[0]
+							}
+						}
+						if hostedDomain := c.String(FlagHostedDomain); hostedDomain != "" {
+							request.Claims = map[string]any{"hd": hostedDomain}
+						}
+
+						decision, err := opksshplugingoogleworkspace.Evaluate(ctx, logger, fetchers(caches), config, request)
+						if err != nil {
+							return err
+						}
+						explain(os.Stdout, decision)
+						return nil
+					},
+				},
+				{
+					Name:        "refresh",
+					Usage:       "refresh cache of all groups referenced by policy",
+					Description: "Fetch members of every group referenced by policy and write them to cache, e.g. from a systemd timer",
+					Action: func(ctx context.Context, c *cli.Command) error {
+						if logger == nil {
+							panic(logger)
+						}
+						config, caches, err := load(ctx, logger, c)
+						if err != nil {
+							return err
+						}
+						var errs []error
+						for _, tenant := range config.Tenants {
+							errs = append(errs, caches[tenant.Name].Refresh(ctx, logger, config.MemberGroups(tenant.Name)))
+						}
+						return errors.Join(errs...)
+					},
+				},
+				{
+					Name:        "serve",
+					Usage:       "run daemon which answers decision requests on the socket",
+					Description: "Keep config and cache in memory and answer decision requests of the plugin on the unix socket",
+					Action: func(ctx context.Context, c *cli.Command) error {
+						if logger == nil {
+							panic(logger)
+						}
+						socketPath := c.String(FlagSocket)
+						if socketPath == "" {
+							return fmt.Errorf("flag %s is required", FlagSocket)
+						}
+						return opksshplugingoogleworkspace.Serve(ctx, logger, socketPath, func(ctx context.Context, logger *slog.Logger) (*opksshplugingoogleworkspace.Config, opksshplugingoogleworkspace.Fetchers, error) {
+							config, caches, err := load(ctx, logger, c)
+							if err != nil {
+								return nil, nil, err
+							}
+							return config, fetchers(caches), nil
+						})
+					},
+				},
+			},
 		}
 		if err := app.Run(ctx, os.Args); err != nil {
 			return err
@@ -148,3 +289,71 @@ func Main() {
 		os.Exit(1)
 	}
 }
+
+func load(
+	ctx context.Context,
+	logger *slog.Logger,
+	c *cli.Command,
+) (*opksshplugingoogleworkspace.Config, map[string]*opksshplugingoogleworkspace.CacheFetcher, error) {
+	config, err := opksshplugingoogleworkspace.LoadConfig(ctx, logger,
+		c.String(FlagConfig),
+		c.String(FlagCache),
+		c.Duration(FlagExpiration),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// every tenant has its own backend, they share the cache file
+	caches := make(map[string]*opksshplugingoogleworkspace.CacheFetcher)
+	for _, tenant := range config.Tenants {
+		tenantConfig := config.Tenant(tenant.Name)
+		fetcher, err := opksshplugingoogleworkspace.NewBackend(ctx, logger, tenantConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+		caches[tenant.Name] = opksshplugingoogleworkspace.NewCacheFetcher(*config.Cache, tenantConfig.CacheNamespace(), fetcher)
+	}
+
+	return config, caches, nil
+}
+
+func fetchers(caches map[string]*opksshplugingoogleworkspace.CacheFetcher) opksshplugingoogleworkspace.Fetchers {
+	result := make(opksshplugingoogleworkspace.Fetchers, len(caches))
+	for name, cache := range caches {
+		result[name] = cache
+	}
+	return result
+}
+
+func explain(w io.Writer, decision *opksshplugingoogleworkspace.Decision) {
+	fmt.Fprintf(w, "decision: %s\n", decision)
+	fmt.Fprintf(w, "reason:   %s (%s)\n", decision.Reason, decision.Reason.Description())
+	if decision.Tenant != "" {
+		fmt.Fprintf(w, "tenant:   %s\n", decision.Tenant)
+	}
+	if decision.ClientID != "" {
+		fmt.Fprintf(w, "client:   %s\n", decision.ClientID)
+	}
+	if decision.Rule != nil {
+		fmt.Fprintf(w, "rule:     %d %s\n", *decision.Rule, decision.RuleDescription)
+	}
+	if decision.Policy != "" {
+		fmt.Fprintf(w, "policy:   %s\n", decision.Policy)
+	}
+	if decision.User != "" {
+		fmt.Fprintf(w, "user:     %s\n", decision.User)
+	}
+	if decision.Condition != "" {
+		fmt.Fprintf(w, "condition: %s\n", decision.Condition)
+	}
+	if decision.Group != "" {
+		fmt.Fprintf(w, "group:    %s\n", decision.Group)
+	}
+	if decision.Stale {
+		fmt.Fprintf(w, "stale:    true (failed to refresh cache)\n")
+	}
+	for _, group := range decision.Groups {
+		fmt.Fprintf(w, "consulted group: %s\n", group)
+	}
+}
@@ -0,0 +1,96 @@
+package opksshplugingoogleworkspace
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	BackendGoogle = "google"
+	BackendFile   = "file"
+	BackendSCIM   = "scim"
+)
+
+type (
+	ConfigBackend struct {
+		Type string             `json:"type"           yaml:"type"` // "google" (default), "file" or "scim"
+		File *ConfigBackendFile `json:"file,omitempty" yaml:"file,omitempty"`
+		SCIM *ConfigBackendSCIM `json:"scim,omitempty" yaml:"scim,omitempty"`
+	}
+
+	// BackendFactory creates the fetcher of a backend from config
+	BackendFactory func(ctx context.Context, logger *slog.Logger, config *Config) (GroupMembersFetcher, error)
+)
+
+var (
+	backendsMutex sync.RWMutex
+	backends      = make(map[string]BackendFactory)
+)
+
+// RegisterBackend makes a backend available by its type in config.
+func RegisterBackend(backendType string, factory BackendFactory) {
+	backendsMutex.Lock()
+	defer backendsMutex.Unlock()
+	if _, ok := backends[backendType]; ok {
+		panic(fmt.Sprintf("backend %s is already registered", backendType))
+	}
+	backends[backendType] = factory
+}
+
+// Backends returns types of registered backends.
+func Backends() []string {
+	backendsMutex.RLock()
+	defer backendsMutex.RUnlock()
+	result := make([]string, 0, len(backends))
+	for backendType := range backends {
+		result = append(result, backendType)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// NewBackend creates the fetcher of the backend selected by config.
+func NewBackend(ctx context.Context, logger *slog.Logger, config *Config) (GroupMembersFetcher, error) {
+	backendsMutex.RLock()
+	factory := backends[config.Backend.Type]
+	backendsMutex.RUnlock()
+	if factory == nil {
+		const message = "unknown backend"
+		logger.ErrorContext(ctx, message,
+			slog.String("backend", config.Backend.Type),
+		)
+		err := fmt.Errorf("%s %s", message, config.Backend.Type)
+		return nil, err
+	}
+	logger.DebugContext(ctx, "create backend",
+		slog.String("backend", config.Backend.Type),
+	)
+	return factory(ctx, logger, config)
+}
+
+// CacheNamespace returns the key which separates cache entries of the backend.
+func (c *Config) CacheNamespace() string {
+	switch c.Backend.Type {
+	case BackendGoogle:
+		return c.Google.Workspace.CustomerID
+	case BackendFile:
+		return BackendFile + ":" + c.resolvePath(c.Backend.File.Path)
+	case BackendSCIM:
+		return BackendSCIM + ":" + strings.TrimSuffix(c.Backend.SCIM.URL, "/")
+	default:
+		return c.Backend.Type
+	}
+}
+
+// resolvePath resolves path relative to the config's directory.
+func (c *Config) resolvePath(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(c.Path), path)
+}
@@ -4,53 +4,67 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gofrs/flock"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
 )
 
 type (
 	ConfigCache struct {
-		Path     *string        `json:"path,omitempty"     yaml:"path,omitempty"`
-		Duration *time.Duration `json:"duration,omitempty" yaml:"duration,omitempty"`
+		Path          *string        `json:"path,omitempty"           yaml:"path,omitempty"`
+		Duration      *time.Duration `json:"duration,omitempty"       yaml:"duration,omitempty"`
+		StaleDuration *time.Duration `json:"stale_duration,omitempty" yaml:"stale_duration,omitempty"` // serve expired entries up to this age when a refresh fails
+		TokenPath     *string        `json:"token_path,omitempty"     yaml:"token_path,omitempty"`     // persist Google access token to reuse it between invocations
 	}
 
 	CacheFetcher struct {
-		customerId string
-		now        time.Time
-		deadline   time.Time
-		fetcher    GroupMembersFetcher
-		path       string
+		customerId    string
+		duration      time.Duration
+		staleDuration time.Duration // zero if stale entries are never served
+		fetcher       GroupMembersFetcher
+		path          string
 
-		mutex sync.Mutex
-		info  *Info
-		lock  *flock.Flock
+		mutex   sync.Mutex
+		info    *Info
+		modTime time.Time // modification time of cache file at last load
+		lock    *flock.Flock
 	}
 )
 
 var (
 	_ GroupMembersFetcher = &CacheFetcher{}
+	_ GroupMemberChecker  = &CacheFetcher{}
+	_ UserGroupsFetcher   = &CacheFetcher{}
 )
 
 func NewCacheFetcher(config ConfigCache, customerId string, fetcher GroupMembersFetcher) *CacheFetcher {
-	now := time.Now()
-	deadline := now.Add(-1 * *config.Duration)
+	var staleDuration time.Duration
+	if config.StaleDuration != nil {
+		staleDuration = *config.StaleDuration
+	}
 	path := *config.Path
 	return &CacheFetcher{
 		// immutable
-		customerId: customerId,
-		now:        now,
-		deadline:   deadline,
-		fetcher:    fetcher,
-		path:       path,
+		customerId:    customerId,
+		duration:      *config.Duration,
+		staleDuration: staleDuration,
+		fetcher:       fetcher,
+		path:          path,
 		// volatile
 		lock: flock.New(path + ".filelock"),
 	}
@@ -61,33 +75,188 @@ func (c *CacheFetcher) GroupMembers(
 	logger *slog.Logger,
 	groupEmail string,
 ) ([]*Member, error) {
-	result := c.get(ctx, logger, groupEmail)
+	now := time.Now()
+	result := c.get(ctx, logger, now.Add(-c.duration), groupEmail)
 	if result != nil {
 		return result, nil
 	}
 	members, err := c.fetcher.GroupMembers(ctx, logger, groupEmail)
 	if err != nil {
+		if c.staleDuration > 0 && ctx.Err() == nil && isTransient(err) {
+			if result := c.get(ctx, logger, now.Add(-c.staleDuration), groupEmail); result != nil {
+				c.serveStale(ctx, logger, err, slog.String("group", groupEmail))
+				return result, nil
+			}
+		}
 		return nil, err
 	}
-	err = c.add(ctx, logger, groupEmail, members)
+	err = c.add(ctx, logger, now, groupEmail, members)
 	if err != nil {
 		return nil, err
 	}
 	return members, nil
 }
 
-func (c *CacheFetcher) get(ctx context.Context, logger *slog.Logger, groupEmail string) []*Member {
+// Refresh fetches members of groups and writes them to cache regardless of their age.
+// It tries every group and returns all failures.
+func (c *CacheFetcher) Refresh(
+	ctx context.Context,
+	logger *slog.Logger,
+	groupEmails []string,
+) error {
+	var errs []error
+	for _, groupEmail := range groupEmails {
+		now := time.Now()
+		members, err := c.fetcher.GroupMembers(ctx, logger, groupEmail)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		err = c.add(ctx, logger, now, groupEmail, members)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		const message = "failed to refresh cache"
+		logger.ErrorContext(ctx, message,
+			slog.Int("groups_count", len(groupEmails)),
+			slog.Int("errors_count", len(errs)),
+		)
+		err = fmt.Errorf("%s %w", message, err)
+		return err
+	}
+	logger.InfoContext(ctx, "refresh cache completed",
+		slog.Int("groups_count", len(groupEmails)),
+	)
+	return nil
+}
+
+func (c *CacheFetcher) HasMember(
+	ctx context.Context,
+	logger *slog.Logger,
+	groupEmail string,
+	userEmail string,
+) (bool, error) {
+	now := time.Now()
+	membership := c.getMembership(ctx, logger, now.Add(-c.duration), groupEmail, userEmail)
+	if membership != nil {
+		return membership.IsMember, nil
+	}
+	checker, ok := c.fetcher.(GroupMemberChecker)
+	if !ok {
+		const message = "fetcher does not support membership check"
+		logger.ErrorContext(ctx, message,
+			slog.String("group", groupEmail),
+			slog.String("email", userEmail),
+		)
+		err := fmt.Errorf("%s group %s email %s", message, groupEmail, userEmail)
+		return false, err
+	}
+	isMember, err := checker.HasMember(ctx, logger, groupEmail, userEmail)
+	if err != nil {
+		if c.staleDuration > 0 && ctx.Err() == nil && isTransient(err) {
+			if membership := c.getMembership(ctx, logger, now.Add(-c.staleDuration), groupEmail, userEmail); membership != nil {
+				c.serveStale(ctx, logger, err, slog.String("group", groupEmail), slog.String("email", userEmail))
+				return membership.IsMember, nil
+			}
+		}
+		return false, err
+	}
+	err = c.addMembership(ctx, logger, now, groupEmail, userEmail, isMember)
+	if err != nil {
+		return false, err
+	}
+	return isMember, nil
+}
+
+func (c *CacheFetcher) UserGroups(
+	ctx context.Context,
+	logger *slog.Logger,
+	userEmail string,
+) ([]string, error) {
+	now := time.Now()
+	user := c.getUser(ctx, logger, now.Add(-c.duration), userEmail)
+	if user != nil {
+		return slices.Clone(user.Groups), nil
+	}
+	fetcher, ok := c.fetcher.(UserGroupsFetcher)
+	if !ok {
+		const message = "fetcher does not support user's groups"
+		logger.ErrorContext(ctx, message,
+			slog.String("email", userEmail),
+		)
+		err := fmt.Errorf("%s email %s", message, userEmail)
+		return nil, err
+	}
+	groups, err := fetcher.UserGroups(ctx, logger, userEmail)
+	if err != nil {
+		if c.staleDuration > 0 && ctx.Err() == nil && isTransient(err) {
+			if user := c.getUser(ctx, logger, now.Add(-c.staleDuration), userEmail); user != nil {
+				c.serveStale(ctx, logger, err, slog.String("email", userEmail))
+				return slices.Clone(user.Groups), nil
+			}
+		}
+		return nil, err
+	}
+	err = c.addUser(ctx, logger, now, userEmail, groups)
+	if err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// statusError is an unexpected HTTP status of a backend's response.
+type statusError struct {
+	StatusCode int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("status %d", e.StatusCode)
+}
+
+// isTransient reports whether err may not repeat on retry: a network failure, a rate limit or a server error.
+// Stale cache is served only for such errors, so a removed group or a revoked permission is not masked.
+func isTransient(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return isTransientStatus(apiErr.Code)
+	}
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) && retrieveErr.Response != nil {
+		return isTransientStatus(retrieveErr.Response.StatusCode)
+	}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return isTransientStatus(statusErr.StatusCode)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func isTransientStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+// serveStale logs the failed refresh and marks the evaluation in ctx as based on stale cache.
+func (c *CacheFetcher) serveStale(ctx context.Context, logger *slog.Logger, err error, attrs ...any) {
+	const message = "failed to refresh cache, serve stale cache"
+	logger.WarnContext(ctx, message,
+		append(attrs, slog.Any("error", err))...,
+	)
+	markStale(ctx)
+}
+
+func (c *CacheFetcher) get(ctx context.Context, logger *slog.Logger, deadline time.Time, groupEmail string) []*Member {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	// check if cache loaded
-	if c.info == nil {
-		// cache not loaded, load cache
-		c.lock.Lock()
-		defer c.lock.Unlock()
-		c.unsafeLoad(ctx, logger)
-	}
+	c.unsafeSync(ctx, logger)
 	// search in cache
-	group := c.info.GetCustomer(c.customerId).GetGroup(c.deadline, groupEmail)
+	group := c.info.GetCustomer(c.customerId).GetGroup(deadline, groupEmail)
 	if group == nil {
 		// cache miss
 		return nil
@@ -106,18 +275,54 @@ func (c *CacheFetcher) get(ctx context.Context, logger *slog.Logger, groupEmail
 	return result
 }
 
-func (c *CacheFetcher) add(ctx context.Context, logger *slog.Logger, groupEmail string, members []*Member) error {
+func (c *CacheFetcher) getMembership(ctx context.Context, logger *slog.Logger, deadline time.Time, groupEmail string, userEmail string) *Membership {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.unsafeSync(ctx, logger)
+	// search in cache
+	return c.info.GetCustomer(c.customerId).GetMembership(deadline, groupEmail, userEmail)
+}
+
+func (c *CacheFetcher) addMembership(ctx context.Context, logger *slog.Logger, fetchTime time.Time, groupEmail string, userEmail string, isMember bool) error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	c.unsafeLoad(ctx, logger)
+	c.info.AddCustomer(c.customerId).AddMembership(fetchTime, groupEmail, userEmail, isMember)
+	return c.unsafeSave(ctx, logger)
+}
+
+func (c *CacheFetcher) getUser(ctx context.Context, logger *slog.Logger, deadline time.Time, userEmail string) *User {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.unsafeSync(ctx, logger)
+	// search in cache
+	return c.info.GetCustomer(c.customerId).GetUser(deadline, userEmail)
+}
+
+func (c *CacheFetcher) addUser(ctx context.Context, logger *slog.Logger, fetchTime time.Time, userEmail string, groups []string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.unsafeLoad(ctx, logger)
+	c.info.AddCustomer(c.customerId).AddUser(fetchTime, userEmail, groups)
+	return c.unsafeSave(ctx, logger)
+}
+
+func (c *CacheFetcher) add(ctx context.Context, logger *slog.Logger, fetchTime time.Time, groupEmail string, members []*Member) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.unsafeLoad(ctx, logger)
+	// the group is added even without members, so an empty group replaces its older members
+	group := c.info.AddCustomer(c.customerId).AddGroup(fetchTime, groupEmail)
 	for index := range members {
-		member := members[index]
-		c.info.AddCustomer(c.customerId).AddGroup(c.now, groupEmail).AddMember(member)
+		group.AddMember(members[index])
 	}
 	return c.unsafeSave(ctx, logger)
-
 }
 
 func (c *CacheFetcher) unsafeSave(ctx context.Context, logger *slog.Logger) error {
@@ -244,12 +449,29 @@ func (c *CacheFetcher) unsafeSave(ctx context.Context, logger *slog.Logger) erro
 	return nil
 }
 
+// unsafeSync loads cache file if it is not loaded yet or was changed by another process, e.g. refresh.
+func (c *CacheFetcher) unsafeSync(ctx context.Context, logger *slog.Logger) {
+	if c.info != nil {
+		stat, err := os.Stat(c.path)
+		if err != nil || stat.ModTime().Equal(c.modTime) {
+			return
+		}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.unsafeLoad(ctx, logger)
+}
+
 func (c *CacheFetcher) unsafeLoad(ctx context.Context, logger *slog.Logger) {
 	defer func() {
 		if c.info == nil {
 			c.info = &Info{}
 		}
 	}()
+	stat, err := os.Stat(c.path)
+	if err == nil {
+		c.modTime = stat.ModTime()
+	}
 	raw, err := os.ReadFile(c.path)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -284,3 +506,22 @@ func (c *CacheFetcher) unsafeLoad(ctx context.Context, logger *slog.Logger) {
 		slog.String("path", c.path),
 	)
 }
+
+type staleContextKey struct{}
+
+// withStaleTracker returns ctx which records whether any answer was served from stale cache.
+func withStaleTracker(ctx context.Context) (context.Context, *atomic.Bool) {
+	stale := &atomic.Bool{}
+	return context.WithValue(ctx, staleContextKey{}, stale), stale
+}
+
+func markStale(ctx context.Context) {
+	if stale, ok := ctx.Value(staleContextKey{}).(*atomic.Bool); ok {
+		stale.Store(true)
+	}
+}
+
+func isStale(ctx context.Context) bool {
+	stale, ok := ctx.Value(staleContextKey{}).(*atomic.Bool)
+	return ok && stale.Load()
+}
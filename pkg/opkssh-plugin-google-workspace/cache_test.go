@@ -0,0 +1,189 @@
+package opksshplugingoogleworkspace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "rate limit", err: &googleapi.Error{Code: http.StatusTooManyRequests}, want: true},
+		{name: "server error", err: &googleapi.Error{Code: http.StatusServiceUnavailable}, want: true},
+		{name: "wrapped server error", err: fmt.Errorf("failed to list members %w", &googleapi.Error{Code: http.StatusInternalServerError}), want: true},
+		{name: "not found", err: &googleapi.Error{Code: http.StatusNotFound}, want: false},
+		{name: "forbidden", err: &googleapi.Error{Code: http.StatusForbidden}, want: false},
+		{name: "token server error", err: &oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusBadGateway}}, want: true},
+		{name: "token denied", err: &oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusUnauthorized}}, want: false},
+		{name: "SCIM server error", err: fmt.Errorf("unexpected status %w", &statusError{StatusCode: http.StatusBadGateway}), want: true},
+		{name: "SCIM not found", err: fmt.Errorf("unexpected status %w", &statusError{StatusCode: http.StatusNotFound}), want: false},
+		{name: "network", err: &url.Error{Op: "Get", URL: "https://admin.googleapis.com", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, want: true},
+		{name: "timeout", err: fmt.Errorf("failed %w", context.DeadlineExceeded), want: true},
+		{name: "truncated response", err: io.ErrUnexpectedEOF, want: true},
+		{name: "group not found in file", err: errors.New("group devs@example.com not found"), want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isTransient(test.err); got != test.want {
+				t.Errorf("isTransient(%v) = %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+// failingFetcher returns members until err is set.
+type failingFetcher struct {
+	members []*Member
+	err     error
+}
+
+var (
+	_ GroupMembersFetcher = &failingFetcher{}
+)
+
+func (f *failingFetcher) GroupMembers(ctx context.Context, logger *slog.Logger, groupEmail string) ([]*Member, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.members, nil
+}
+
+func TestCacheFetcherStale(t *testing.T) {
+	logger := slog.New(slog.DiscardHandler)
+	members := []*Member{{Email: "alice@example.com", Status: MemberStatusActive}}
+	newCache := func(t *testing.T, staleDuration time.Duration) (*CacheFetcher, *failingFetcher) {
+		path := filepath.Join(t.TempDir(), "cache.json")
+		duration := time.Millisecond
+		fetcher := &failingFetcher{members: members}
+		cache := NewCacheFetcher(ConfigCache{Path: &path, Duration: &duration, StaleDuration: &staleDuration}, "customer", fetcher)
+		// warm up the cache and let the entry expire
+		if _, err := cache.GroupMembers(context.Background(), logger, "devs@example.com"); err != nil {
+			t.Fatalf("GroupMembers() = %v", err)
+		}
+		time.Sleep(2 * duration)
+		return cache, fetcher
+	}
+
+	tests := []struct {
+		name          string
+		staleDuration time.Duration
+		err           error
+		stale         bool // served from stale cache, fails otherwise
+	}{
+		{name: "transient error", staleDuration: time.Hour, err: &googleapi.Error{Code: http.StatusServiceUnavailable}, stale: true},
+		{name: "permanent error", staleDuration: time.Hour, err: &googleapi.Error{Code: http.StatusNotFound}},
+		{name: "transient error without stale duration", err: &googleapi.Error{Code: http.StatusServiceUnavailable}},
+		{name: "transient error after stale duration", staleDuration: time.Nanosecond, err: &googleapi.Error{Code: http.StatusServiceUnavailable}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache, fetcher := newCache(t, test.staleDuration)
+			fetcher.err = test.err
+
+			ctx, stale := withStaleTracker(context.Background())
+			got, err := cache.GroupMembers(ctx, logger, "devs@example.com")
+			if !test.stale {
+				if err == nil {
+					t.Errorf("GroupMembers() = %v, want error", got)
+				}
+				if stale.Load() {
+					t.Errorf("GroupMembers() marked the evaluation as stale")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GroupMembers() = %v", err)
+			}
+			if len(got) != 1 || got[0].Email != "alice@example.com" {
+				t.Errorf("GroupMembers() = %v, want stale members", got)
+			}
+			if !stale.Load() {
+				t.Errorf("GroupMembers() did not mark the evaluation as stale")
+			}
+		})
+	}
+}
+
+// countingFetcher counts fetches of groups.
+type countingFetcher struct {
+	failingFetcher
+	count int
+}
+
+func (f *countingFetcher) GroupMembers(ctx context.Context, logger *slog.Logger, groupEmail string) ([]*Member, error) {
+	f.count++
+	return f.failingFetcher.GroupMembers(ctx, logger, groupEmail)
+}
+
+func TestCacheFetcherEmptyGroup(t *testing.T) {
+	logger := slog.New(slog.DiscardHandler)
+	path := filepath.Join(t.TempDir(), "cache.json")
+
+	t.Run("empty group is cached", func(t *testing.T) {
+		duration := time.Hour
+		fetcher := &countingFetcher{}
+		cache := NewCacheFetcher(ConfigCache{Path: &path, Duration: &duration}, "empty", fetcher)
+		for range 2 {
+			members, err := cache.GroupMembers(context.Background(), logger, "empty@example.com")
+			if err != nil || len(members) != 0 {
+				t.Fatalf("GroupMembers() = %v, %v, want no members", members, err)
+			}
+		}
+		if fetcher.count != 1 {
+			t.Errorf("group fetched %d times, want 1", fetcher.count)
+		}
+	})
+
+	t.Run("empty group replaces removed members", func(t *testing.T) {
+		duration := time.Millisecond
+		staleDuration := time.Hour
+		fetcher := &countingFetcher{failingFetcher: failingFetcher{members: []*Member{{Email: "alice@example.com", Status: MemberStatusActive}}}}
+		cache := NewCacheFetcher(ConfigCache{Path: &path, Duration: &duration, StaleDuration: &staleDuration}, "removed", fetcher)
+		if _, err := cache.GroupMembers(context.Background(), logger, "devs@example.com"); err != nil {
+			t.Fatalf("GroupMembers() = %v", err)
+		}
+
+		// every member is removed
+		fetcher.members = nil
+		if err := cache.Refresh(context.Background(), logger, []string{"devs@example.com"}); err != nil {
+			t.Fatalf("Refresh() = %v", err)
+		}
+		time.Sleep(2 * duration)
+
+		// stale cache serves the empty group, not the removed members
+		fetcher.err = &googleapi.Error{Code: http.StatusServiceUnavailable}
+		members, err := cache.GroupMembers(context.Background(), logger, "devs@example.com")
+		if err != nil {
+			t.Fatalf("GroupMembers() = %v", err)
+		}
+		if len(members) != 0 {
+			t.Errorf("GroupMembers() = %v, want no members", members)
+		}
+	})
+}
+
+func TestCacheFetcherHasMemberUnsupported(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	duration := time.Hour
+	fetcher := &failingFetcher{members: []*Member{{Email: "alice@example.com", Status: MemberStatusSuspended}}}
+	cache := NewCacheFetcher(ConfigCache{Path: &path, Duration: &duration}, "customer", fetcher)
+	// listing members would ignore their status, so the check fails instead
+	if isMember, err := cache.HasMember(context.Background(), slog.New(slog.DiscardHandler), "staff@example.com", "alice@example.com"); err == nil {
+		t.Errorf("HasMember() = %v, want error", isMember)
+	}
+}
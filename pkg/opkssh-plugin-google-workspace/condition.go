@@ -0,0 +1,87 @@
+package opksshplugingoogleworkspace
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+)
+
+// conditionCostLimit bounds the cost of a single evaluation, so a condition cannot stall the login
+const conditionCostLimit = 10000
+
+// conditionEnv declares the variables available to conditions of policy.
+var conditionEnv = sync.OnceValues(func() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("principal", cel.StringType),
+		cel.Variable("email", cel.StringType),
+		cel.Variable("email_verified", cel.BoolType),
+		cel.Variable("aud", cel.StringType),
+		cel.Variable("iss", cel.StringType),
+		cel.Variable("sub", cel.StringType),
+		cel.Variable("hd", cel.StringType),
+		cel.Variable("tenant", cel.StringType),
+		cel.Variable("claims", cel.MapType(cel.StringType, cel.DynType)),
+	)
+})
+
+// compileConditions parses and type-checks CEL expressions which must evaluate to bool.
+func compileConditions(expressions []string) ([]cel.Program, error) {
+	env, err := conditionEnv()
+	if err != nil {
+		return nil, err
+	}
+	programs := make([]cel.Program, 0, len(expressions))
+	for _, expression := range expressions {
+		ast, issues := env.Compile(expression)
+		if issues.Err() != nil {
+			return nil, fmt.Errorf("condition %q %w", expression, issues.Err())
+		}
+		if ast.OutputType() != cel.BoolType {
+			return nil, fmt.Errorf("condition %q returns %s instead of bool", expression, ast.OutputType())
+		}
+		program, err := env.Program(ast, cel.CostLimit(conditionCostLimit))
+		if err != nil {
+			return nil, fmt.Errorf("condition %q %w", expression, err)
+		}
+		programs = append(programs, program)
+	}
+	return programs, nil
+}
+
+// conditionVariables returns values of variables of conditions for the request.
+func conditionVariables(request *Request, tenant string) map[string]any {
+	claims := request.Claims
+	if claims == nil {
+		claims = map[string]any{}
+	}
+	return map[string]any{
+		"principal":      request.Principal,
+		"email":          request.Email,
+		"email_verified": request.EmailVerified,
+		"aud":            request.ClientID,
+		"iss":            request.Iss(),
+		"sub":            request.Sub(),
+		"hd":             request.HostedDomain(),
+		"tenant":         tenant,
+		"claims":         claims,
+	}
+}
+
+// matchConditions returns the first expression which evaluates to true or empty string.
+// Expressions which fail to evaluate are skipped and their errors are joined, the caller decides whether it fails closed.
+func matchConditions(expressions []string, programs []cel.Program, variables map[string]any) (string, error) {
+	var errs []error
+	for index, program := range programs {
+		value, _, err := program.Eval(variables)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("condition %q %w", expressions[index], err))
+			continue
+		}
+		if matched, ok := value.Value().(bool); ok && matched {
+			return expressions[index], errors.Join(errs...)
+		}
+	}
+	return "", errors.Join(errs...)
+}
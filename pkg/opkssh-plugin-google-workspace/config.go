@@ -5,21 +5,27 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strings"
 	"time"
 
 	"log/slog"
 
-	"golang.org/x/oauth2/google"
-	admin "google.golang.org/api/admin/directory/v1"
 	"gopkg.in/yaml.v3"
 )
 
 type (
 	Config struct {
-		Google ConfigGoogle `json:"google"          yaml:"google"`
-		Policy Policy       `json:"policy"          yaml:"policy"`
-		Cache  *ConfigCache `json:"cache,omitempty" yaml:"cache,omitempty"`
+		Google      ConfigGoogle   `json:"google"                yaml:"google"`            // single tenant, the first tenant after load
+		Tenants     []ConfigTenant `json:"tenants,omitempty"     yaml:"tenants,omitempty"` // several Google Workspaces instead of google
+		Backend     *ConfigBackend `json:"backend,omitempty"     yaml:"backend,omitempty"`
+		Groups      LocalGroups    `json:"groups,omitempty"      yaml:"groups,omitempty"` // local groups resolved without backend
+		Policy      Policy         `json:"policy"                yaml:"policy"`
+		Rules       []*PolicyRule  `json:"rules,omitempty"       yaml:"rules,omitempty"` // ordered rules, evaluated before policy
+		Cache       *ConfigCache   `json:"cache,omitempty"       yaml:"cache,omitempty"`
+		Concurrency *int           `json:"concurrency,omitempty" yaml:"concurrency,omitempty"` // max groups fetched at the same time
+		Path        string         `json:"-"                     yaml:"-"`                     // absolute path to config file
 	}
 )
 
@@ -83,33 +89,28 @@ func LoadConfig(
 		)
 		return nil, err
 	}
+	result.Path = pathConfig
 
-	for principal := range result.Policy {
-		policy := result.Policy[principal]
-		sort.Strings(policy.User)
-		sort.Strings(policy.Group)
-	}
-
-	logger.DebugContext(ctx, "load config file completed")
-
-	// get absolute path to servire account key file
-	serviceAccountKeyPath := result.Google.ServiceAccount.KeyFile
-	if !filepath.IsAbs(serviceAccountKeyPath) {
-		serviceAccountKeyPath = filepath.Join(
-			filepath.Dir(pathConfig),
-			serviceAccountKeyPath,
+	if len(result.Tenants) == 0 {
+		result.Tenants = []ConfigTenant{{ConfigGoogle: result.Google}}
+	} else if len(result.Google.OAuth.AllClientIDs()) > 0 || result.Google.Workspace.CustomerID != "" ||
+		result.Google.ServiceAccount.Email != "" || result.Google.ServiceAccount.KeyFile != "" {
+		const message = "google and tenants are mutually exclusive"
+		logger.ErrorContext(ctx,
+			message,
+			slog.String("path", pathConfig),
 		)
+		err = fmt.Errorf("%s path %s",
+			message,
+			pathConfig,
+		)
+		return nil, err
 	}
-
-	// load service account key file
-	logger.DebugContext(ctx, "read service account file",
-		slog.String("path", serviceAccountKeyPath),
-	)
-	data, err = os.ReadFile(serviceAccountKeyPath)
-	if err != nil {
-		const message = "failed to read service account file"
-		logger.ErrorContext(ctx, message,
-			slog.String("path", serviceAccountKeyPath),
+	if err = validateTenants(result.Tenants); err != nil {
+		const message = "invalid tenants"
+		logger.ErrorContext(ctx,
+			message,
+			slog.String("path", pathConfig),
 			slog.Any("error", err),
 		)
 		err = fmt.Errorf("%s path %s %w",
@@ -120,15 +121,92 @@ func LoadConfig(
 		return nil, err
 	}
 
-	// parse service account key file
-	logger.DebugContext(ctx, "parse service account file",
-		slog.String("path", serviceAccountKeyPath),
-	)
-	result.Google.ServiceAccount.Key, err = google.JWTConfigFromJSON(data, admin.AdminDirectoryGroupMemberReadonlyScope)
-	if err != nil {
-		const message = "failed to parse Google Service Account key file"
-		logger.ErrorContext(ctx, message,
-			slog.String("path", serviceAccountKeyPath),
+	if result.Backend == nil {
+		result.Backend = &ConfigBackend{}
+	}
+	if result.Backend.Type == "" {
+		result.Backend.Type = BackendGoogle
+	}
+	if !slices.Contains(Backends(), result.Backend.Type) {
+		const message = "unknown backend"
+		logger.ErrorContext(ctx,
+			message,
+			slog.String("path", pathConfig),
+			slog.String("backend", result.Backend.Type),
+			slog.Any("backends", Backends()),
+		)
+		err = fmt.Errorf("%s %s path %s",
+			message,
+			result.Backend.Type,
+			pathConfig,
+		)
+		return nil, err
+	}
+
+	for index := range result.Tenants {
+		tenant := &result.Tenants[index]
+		if len(tenant.OAuth.AllowedIssuers) == 0 {
+			tenant.OAuth.AllowedIssuers = []string{DefaultIssuer}
+		}
+		switch tenant.Workspace.Lookup {
+		case "":
+			tenant.Workspace.Lookup = LookupMembers
+		case LookupMembers:
+		case LookupUserGroups:
+			if result.Backend.Type != BackendGoogle {
+				const message = "lookup is supported only by backend " + BackendGoogle
+				logger.ErrorContext(ctx,
+					message,
+					slog.String("path", pathConfig),
+					slog.String("tenant", tenant.Name),
+					slog.String("lookup", tenant.Workspace.Lookup),
+					slog.String("backend", result.Backend.Type),
+				)
+				err = fmt.Errorf("%s lookup %s backend %s path %s",
+					message,
+					tenant.Workspace.Lookup,
+					result.Backend.Type,
+					pathConfig,
+				)
+				return nil, err
+			}
+		default:
+			const message = "unknown lookup of workspace"
+			logger.ErrorContext(ctx,
+				message,
+				slog.String("path", pathConfig),
+				slog.String("tenant", tenant.Name),
+				slog.String("lookup", tenant.Workspace.Lookup),
+			)
+			err = fmt.Errorf("%s %s path %s",
+				message,
+				tenant.Workspace.Lookup,
+				pathConfig,
+			)
+			return nil, err
+		}
+		if len(tenant.Workspace.HasMemberGroups) > 0 && result.Backend.Type != BackendGoogle {
+			const message = "has_member_groups are supported only by backend " + BackendGoogle
+			logger.ErrorContext(ctx,
+				message,
+				slog.String("path", pathConfig),
+				slog.String("tenant", tenant.Name),
+				slog.String("backend", result.Backend.Type),
+			)
+			err = fmt.Errorf("%s backend %s path %s",
+				message,
+				result.Backend.Type,
+				pathConfig,
+			)
+			return nil, err
+		}
+	}
+
+	if err = result.Groups.Validate(); err != nil {
+		const message = "invalid local groups"
+		logger.ErrorContext(ctx,
+			message,
+			slog.String("path", pathConfig),
 			slog.Any("error", err),
 		)
 		err = fmt.Errorf("%s path %s %w",
@@ -139,7 +217,154 @@ func LoadConfig(
 		return nil, err
 	}
 
-	logger.DebugContext(ctx, "load service account file completed")
+	for principal := range result.Policy {
+		policy := result.Policy[principal]
+		if policy == nil {
+			// e.g. "root:" without a value
+			const message = "policy of principal is empty"
+			logger.ErrorContext(ctx,
+				message,
+				slog.String("path", pathConfig),
+				slog.String("principal", principal),
+			)
+			err = fmt.Errorf("%s %s path %s",
+				message,
+				principal,
+				pathConfig,
+			)
+			return nil, err
+		}
+		if err = policy.Validate(principal); err != nil {
+			const message = "invalid policy of principal"
+			logger.ErrorContext(ctx,
+				message,
+				slog.String("path", pathConfig),
+				slog.String("principal", principal),
+				slog.Any("error", err),
+			)
+			err = fmt.Errorf("%s %s path %s %w",
+				message,
+				principal,
+				pathConfig,
+				err,
+			)
+			return nil, err
+		}
+		for _, clientID := range policy.ClientIDs {
+			if _, ok := result.TenantByClientID(clientID); !ok {
+				const message = "unknown client_id of principal"
+				logger.ErrorContext(ctx,
+					message,
+					slog.String("path", pathConfig),
+					slog.String("principal", principal),
+					slog.String("client_id", clientID),
+				)
+				err = fmt.Errorf("%s %s client_id %s path %s",
+					message,
+					principal,
+					clientID,
+					pathConfig,
+				)
+				return nil, err
+			}
+		}
+		sort.Strings(policy.User)
+		for index, group := range slices.Concat(policy.Group, policy.DenyGroup) {
+			deny := index >= len(policy.Group)
+			if err = result.validateGroup(group, policy, deny); err != nil {
+				const message = "invalid group of principal"
+				logger.ErrorContext(ctx,
+					message,
+					slog.String("path", pathConfig),
+					slog.String("principal", principal),
+					slog.String("group", group.Group),
+					slog.Any("error", err),
+				)
+				err = fmt.Errorf("%s %s group %s path %s %w",
+					message,
+					principal,
+					group.Group,
+					pathConfig,
+					err,
+				)
+				return nil, err
+			}
+		}
+		sortGroups(policy.Group)
+		sort.Strings(policy.DenyUser)
+		sortGroups(policy.DenyGroup)
+	}
+
+	for index, rule := range result.Rules {
+		if err = rule.Validate(); err != nil {
+			const message = "invalid rule"
+			logger.ErrorContext(ctx,
+				message,
+				slog.String("path", pathConfig),
+				slog.Int("rule", index),
+				slog.Any("error", err),
+			)
+			err = fmt.Errorf("%s %d path %s %w",
+				message,
+				index,
+				pathConfig,
+				err,
+			)
+			return nil, err
+		}
+		for _, group := range rule.Group {
+			if err = result.validateGroup(group, rule.subject, rule.Effect == RuleEffectDeny); err != nil {
+				const message = "invalid group of rule"
+				logger.ErrorContext(ctx,
+					message,
+					slog.String("path", pathConfig),
+					slog.Int("rule", index),
+					slog.String("group", group.Group),
+					slog.Any("error", err),
+				)
+				err = fmt.Errorf("%s %d group %s path %s %w",
+					message,
+					index,
+					group.Group,
+					pathConfig,
+					err,
+				)
+				return nil, err
+			}
+		}
+	}
+
+	logger.DebugContext(ctx, "load config file completed")
+
+	// only the google backend needs the service account
+	if result.Backend.Type == BackendGoogle {
+		for index := range result.Tenants {
+			tenant := &result.Tenants[index]
+			if err = tenant.ServiceAccount.Validate(); err != nil {
+				const message = "invalid service account"
+				logger.ErrorContext(ctx,
+					message,
+					slog.String("path", pathConfig),
+					slog.String("tenant", tenant.Name),
+					slog.Any("error", err),
+				)
+				err = fmt.Errorf("%s tenant %q path %s %w",
+					message,
+					tenant.Name,
+					pathConfig,
+					err,
+				)
+				return nil, err
+			}
+
+			// load credentials of service account
+			err = tenant.ServiceAccount.load(ctx, logger, pathConfig, tenant.Workspace.Scopes())
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	result.Google = result.Tenants[0].ConfigGoogle
 
 	// defaults
 	if result.Cache == nil {
@@ -151,6 +376,108 @@ func LoadConfig(
 	if result.Cache.Duration == nil {
 		result.Cache.Duration = &cacheDuration
 	}
+	if staleDuration := result.Cache.StaleDuration; staleDuration != nil && *staleDuration <= *result.Cache.Duration {
+		const message = "cache stale_duration must be longer than duration"
+		logger.ErrorContext(ctx, message,
+			slog.String("path", pathConfig),
+			slog.Duration("stale_duration", *staleDuration),
+			slog.Duration("duration", *result.Cache.Duration),
+		)
+		err = fmt.Errorf("%s stale_duration %s duration %s path %s",
+			message,
+			*staleDuration,
+			*result.Cache.Duration,
+			pathConfig,
+		)
+		return nil, err
+	}
+	if result.Concurrency == nil {
+		concurrency := DefaultConcurrency
+		result.Concurrency = &concurrency
+	}
+	if *result.Concurrency < 1 {
+		const message = "concurrency must be positive"
+		logger.ErrorContext(ctx, message,
+			slog.String("path", pathConfig),
+			slog.Int("concurrency", *result.Concurrency),
+		)
+		err = fmt.Errorf("%s concurrency %d path %s",
+			message,
+			*result.Concurrency,
+			pathConfig,
+		)
+		return nil, err
+	}
 
 	return &result, nil
 }
+
+// validateGroup checks a group of policy against local groups and tenants.
+// Settings of policy which a lookup of the group cannot honour are rejected instead of being ignored.
+func (c *Config) validateGroup(group PolicyGroup, policy *PolicyPrincipal, deny bool) error {
+	if c.Groups.Has(group.Group) {
+		if len(group.Roles) > 0 {
+			return fmt.Errorf("roles are not supported for local groups")
+		}
+		return nil
+	}
+	if name, _, ok := strings.Cut(group.Group, TenantSeparator); ok && c.Tenant(name) == nil {
+		return fmt.Errorf("unknown tenant %q", name)
+	}
+	tenantName, groupEmail := c.SplitGroup(group.Group)
+	if containsFold(c.Tenant(tenantName).Google.Workspace.HasMemberGroups, groupEmail) {
+		// members.hasMember checks the email and does not return member's status, type or role
+		if len(group.Roles) > 0 {
+			return fmt.Errorf("roles are not supported for has_member_groups")
+		}
+		// deny groups apply to every member and match by email anyway
+		if !deny && !policy.AllowAnyMember() {
+			return fmt.Errorf("has_member_groups allow suspended members, set member_statuses [%s, %s] without member_types and email_fallback false",
+				MemberStatusActive,
+				MemberStatusSuspended,
+			)
+		}
+	}
+	return nil
+}
+
+// MemberGroups returns distinct emails of the tenant's groups referenced by policy and rules which are resolved by listing their members.
+// Local groups, groups in has_member_groups and groups resolved from groups of the user are skipped.
+func (c *Config) MemberGroups(tenant string) []string {
+	workspace := c.Tenant(tenant).Google.Workspace
+	set := make(map[string]struct{})
+	add := func(groups []PolicyGroup, policy *PolicyPrincipal, deny bool) {
+		for _, group := range groups {
+			if c.Groups.Has(group.Group) {
+				continue
+			}
+			tenantName, groupEmail := c.SplitGroup(group.Group)
+			if tenantName != tenant {
+				continue
+			}
+			if containsFold(workspace.HasMemberGroups, groupEmail) {
+				continue
+			}
+			if workspace.userGroupsLookup(group, policy, deny) {
+				continue
+			}
+			set[groupEmail] = struct{}{}
+		}
+	}
+	for _, policy := range c.Policy {
+		if policy == nil {
+			continue
+		}
+		add(policy.Group, policy, false)
+		add(policy.DenyGroup, policy, true)
+	}
+	for _, rule := range c.Rules {
+		add(rule.Group, rule.subject, rule.Effect == RuleEffectDeny)
+	}
+	result := make([]string, 0, len(set))
+	for groupEmail := range set {
+		result = append(result, groupEmail)
+	}
+	sort.Strings(result)
+	return result
+}
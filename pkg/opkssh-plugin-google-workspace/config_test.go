@@ -0,0 +1,207 @@
+package opksshplugingoogleworkspace
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadKeyFileConfig loads the config from data next to a service account key file key.json.
+func loadKeyFileConfig(t *testing.T, data string) (*Config, error) {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// the key is parsed only when a token is requested
+	key := `{"type":"service_account","client_email":"sa@example.iam.gserviceaccount.com","private_key":"key"}`
+	if err := os.WriteFile(filepath.Join(dir, "key.json"), []byte(key), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadConfig(context.Background(), slog.New(slog.DiscardHandler), path, filepath.Join(dir, "cache.json"), time.Minute)
+}
+
+func TestLoadConfigHasMemberGroups(t *testing.T) {
+	const workspace = `
+google:
+  workspace:
+    customer_id: customer
+    has_member_groups: [staff@example.com]
+  service_account:
+    key_file: key.json
+`
+	tests := []struct {
+		name   string
+		config string
+		valid  bool
+	}{
+		{
+			name: "every member allowed",
+			config: workspace + `
+policy:
+  root:
+    groups: [staff@example.com]
+    member_statuses: [ACTIVE, SUSPENDED]
+`,
+			valid: true,
+		},
+		{
+			name: "default statuses",
+			config: workspace + `
+policy:
+  root:
+    groups: [staff@example.com]
+`,
+		},
+		{
+			name: "only active members",
+			config: workspace + `
+policy:
+  root:
+    groups: [staff@example.com]
+    member_statuses: [ACTIVE]
+`,
+		},
+		{
+			name: "member types",
+			config: workspace + `
+policy:
+  root:
+    groups: [staff@example.com]
+    member_statuses: [ACTIVE, SUSPENDED]
+    member_types: [USER]
+`,
+		},
+		{
+			name: "no email fallback",
+			config: workspace + `
+policy:
+  root:
+    groups: [staff@example.com]
+    member_statuses: [ACTIVE, SUSPENDED]
+    email_fallback: false
+`,
+		},
+		{
+			name: "roles",
+			config: workspace + `
+policy:
+  root:
+    groups:
+      - group: staff@example.com
+        roles: [OWNER]
+    member_statuses: [ACTIVE, SUSPENDED]
+`,
+		},
+		{
+			name: "deny group with default statuses",
+			config: workspace + `
+policy:
+  root:
+    users: ["*@example.com"]
+    deny_groups: [staff@example.com]
+    email_fallback: false
+`,
+			valid: true,
+		},
+		{
+			name: "rule with default statuses",
+			config: workspace + `
+rules:
+  - principals: [root]
+    effect: allow
+    groups: [staff@example.com]
+`,
+		},
+		{
+			name: "file backend",
+			config: workspace + `
+backend:
+  type: file
+  file:
+    path: groups.yaml
+policy:
+  root:
+    groups: [staff@example.com]
+    member_statuses: [ACTIVE, SUSPENDED]
+`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := loadKeyFileConfig(t, test.config)
+			if (err == nil) != test.valid {
+				t.Errorf("LoadConfig() = %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestMemberGroupsUserGroupsLookup(t *testing.T) {
+	config, err := loadKeyFileConfig(t, `
+google:
+  workspace:
+    customer_id: customer
+    lookup: user_groups
+  service_account:
+    key_file: key.json
+policy:
+  root:
+    groups: [devs@example.com]
+  deploy:
+    groups: [deploy@example.com]
+    member_statuses: [ACTIVE, SUSPENDED]
+  admin:
+    groups:
+      - group: admins@example.com
+        roles: [OWNER]
+    member_statuses: [ACTIVE, SUSPENDED]
+  guest:
+    users: ["*@example.com"]
+    deny_groups: [contractors@example.com]
+    member_statuses: [ACTIVE, SUSPENDED]
+`)
+	if err != nil {
+		t.Fatalf("LoadConfig() = %v", err)
+	}
+	// groups.list does not return the status, so only groups of a policy which allows every member are skipped
+	want := []string{"admins@example.com", "contractors@example.com", "devs@example.com"}
+	if got := config.MemberGroups(""); !slices.Equal(got, want) {
+		t.Errorf("MemberGroups() = %v, want %v", got, want)
+	}
+}
+
+func TestLoadConfigEmptyPolicy(t *testing.T) {
+	_, err := loadKeyFileConfig(t, `
+google:
+  workspace:
+    customer_id: customer
+  service_account:
+    key_file: key.json
+policy:
+  root:
+`)
+	if err == nil || !strings.Contains(err.Error(), "policy of principal is empty") {
+		t.Errorf("LoadConfig() = %v, want empty policy error", err)
+	}
+}
+
+func TestMemberGroupsEmptyPolicy(t *testing.T) {
+	config := &Config{
+		Tenants: []ConfigTenant{{}},
+		Policy: Policy{
+			"root":   nil,
+			"deploy": {Group: []PolicyGroup{{Group: "deploy@example.com"}}},
+		},
+	}
+	want := []string{"deploy@example.com"}
+	if got := config.MemberGroups(""); !slices.Equal(got, want) {
+		t.Errorf("MemberGroups() = %v, want %v", got, want)
+	}
+}
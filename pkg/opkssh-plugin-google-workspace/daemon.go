@@ -0,0 +1,362 @@
+package opksshplugingoogleworkspace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type (
+	daemonResponse struct {
+		Decision *Decision `json:"decision,omitempty"`
+		Error    string    `json:"error,omitempty"`
+	}
+
+	// Loader loads the config and creates fetchers of its tenants.
+	Loader func(ctx context.Context, logger *slog.Logger) (*Config, Fetchers, error)
+
+	// daemonConfig keeps the config of the daemon in sync with its file.
+	daemonConfig struct {
+		load Loader
+		path string // path to config file
+
+		mutex    sync.Mutex
+		modTime  time.Time // modification time of config file at last load
+		config   *Config
+		fetchers Fetchers
+		err      error // failure of last load, requests are not evaluated until the file is fixed
+	}
+)
+
+// ErrDaemonUnavailable is returned by Ask when the daemon does not listen on the socket.
+var ErrDaemonUnavailable = errors.New("daemon unavailable")
+
+// Serve answers decision requests on the unix socket until ctx is done.
+// Every connection carries one JSON Request and receives one JSON response with the Decision.
+// The config is loaded again when its file is modified or the daemon receives SIGHUP.
+func Serve(ctx context.Context, logger *slog.Logger, socketPath string, load Loader) error {
+	daemon, err := newDaemonConfig(ctx, logger, load)
+	if err != nil {
+		return err
+	}
+
+	// create socket dir
+	parentPath := filepath.Dir(socketPath)
+	err = os.MkdirAll(parentPath, 0755)
+	if err != nil {
+		const message = "failed to create socket directory"
+		logger.ErrorContext(ctx, message,
+			slog.String("path", parentPath),
+			slog.Any("error", err),
+		)
+		err = fmt.Errorf("%s directory %s problem %w",
+			message,
+			parentPath,
+			err,
+		)
+		return err
+	}
+
+	// remove socket left by previous daemon
+	if stat, err := os.Lstat(socketPath); err == nil && stat.Mode().Type() == os.ModeSocket {
+		_ = os.Remove(socketPath)
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		const message = "failed to listen socket"
+		logger.ErrorContext(ctx, message,
+			slog.String("path", socketPath),
+			slog.Any("error", err),
+		)
+		err = fmt.Errorf("%s path %s problem %w",
+			message,
+			socketPath,
+			err,
+		)
+		return err
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	// only the owner and the group (opksshuser) may ask for decisions
+	err = os.Chmod(socketPath, 0660)
+	if err != nil {
+		const message = "failed to change socket mode"
+		logger.ErrorContext(ctx, message,
+			slog.String("path", socketPath),
+			slog.Any("error", err),
+		)
+		err = fmt.Errorf("%s path %s problem %w",
+			message,
+			socketPath,
+			err,
+		)
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hangup:
+				daemon.reload(ctx, logger)
+			}
+		}
+	}()
+
+	logger.InfoContext(ctx, "daemon started",
+		slog.String("path", socketPath),
+	)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				logger.InfoContext(ctx, "daemon stopped",
+					slog.String("path", socketPath),
+				)
+				return nil
+			}
+			const message = "failed to accept connection"
+			logger.ErrorContext(ctx, message,
+				slog.String("path", socketPath),
+				slog.Any("error", err),
+			)
+			err = fmt.Errorf("%s path %s problem %w",
+				message,
+				socketPath,
+				err,
+			)
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveConn(ctx, logger, conn, daemon)
+		}()
+	}
+}
+
+func serveConn(ctx context.Context, logger *slog.Logger, conn net.Conn, daemon *daemonConfig) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, DefaultDaemonTimeout)
+	defer cancel()
+	_ = conn.SetDeadline(time.Now().Add(DefaultDaemonTimeout))
+
+	var request Request
+	if err := json.NewDecoder(conn).Decode(&request); err != nil {
+		const message = "failed to read request"
+		logger.ErrorContext(ctx, message,
+			slog.Any("error", err),
+		)
+		return
+	}
+
+	var response daemonResponse
+	config, fetchers, err := daemon.get(ctx, logger)
+	var decision *Decision
+	if err == nil {
+		decision, err = Evaluate(ctx, logger, fetchers, config, &request)
+	}
+	if err != nil {
+		response.Error = err.Error()
+	} else {
+		response.Decision = decision
+	}
+
+	if err := json.NewEncoder(conn).Encode(&response); err != nil {
+		const message = "failed to write response"
+		logger.ErrorContext(ctx, message,
+			slog.Any("error", err),
+		)
+	}
+}
+
+func newDaemonConfig(ctx context.Context, logger *slog.Logger, load Loader) (*daemonConfig, error) {
+	config, fetchers, err := load(ctx, logger)
+	if err != nil {
+		return nil, err
+	}
+	d := &daemonConfig{
+		load:     load,
+		path:     config.Path,
+		config:   config,
+		fetchers: fetchers,
+	}
+	if stat, err := os.Stat(d.path); err == nil {
+		d.modTime = stat.ModTime()
+	}
+	return d, nil
+}
+
+// get returns the config and its fetchers, it loads them again if the config file is modified since last load.
+func (d *daemonConfig) get(ctx context.Context, logger *slog.Logger) (*Config, Fetchers, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	stat, err := os.Stat(d.path)
+	if err != nil {
+		const message = "failed to stat config"
+		logger.ErrorContext(ctx, message,
+			slog.String("path", d.path),
+			slog.Any("error", err),
+		)
+		err = fmt.Errorf("%s path %s %w", message, d.path, err)
+		return nil, nil, err
+	}
+	if !stat.ModTime().Equal(d.modTime) {
+		d.modTime = stat.ModTime()
+		d.unsafeReload(ctx, logger)
+	}
+	if d.err != nil {
+		return nil, nil, d.err
+	}
+	return d.config, d.fetchers, nil
+}
+
+// reload loads the config regardless of its modification time.
+func (d *daemonConfig) reload(ctx context.Context, logger *slog.Logger) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if stat, err := os.Stat(d.path); err == nil {
+		d.modTime = stat.ModTime()
+	}
+	d.unsafeReload(ctx, logger)
+}
+
+// unsafeReload loads the config, on failure the daemon fails requests like the plugin would without it.
+func (d *daemonConfig) unsafeReload(ctx context.Context, logger *slog.Logger) {
+	config, fetchers, err := d.load(ctx, logger)
+	if err != nil {
+		const message = "failed to reload config"
+		logger.ErrorContext(ctx, message,
+			slog.String("path", d.path),
+			slog.Any("error", err),
+		)
+		d.err = fmt.Errorf("%s path %s %w", message, d.path, err)
+		return
+	}
+	d.config, d.fetchers, d.err = config, fetchers, nil
+	logger.InfoContext(ctx, "config reloaded",
+		slog.String("path", d.path),
+	)
+}
+
+// Ask requests the decision from the daemon listening on the unix socket.
+// The error wraps ErrDaemonUnavailable if the daemon cannot be reached.
+func Ask(ctx context.Context, logger *slog.Logger, socketPath string, request *Request) (*Decision, error) {
+	dialer := net.Dialer{Timeout: time.Second}
+	conn, err := dialer.DialContext(ctx, "unix", socketPath)
+	if err != nil {
+		const message = "failed to connect daemon"
+		logger.DebugContext(ctx, message,
+			slog.String("path", socketPath),
+			slog.Any("error", err),
+		)
+		err = fmt.Errorf("%s path %s problem %w %w",
+			message,
+			socketPath,
+			ErrDaemonUnavailable,
+			err,
+		)
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(DefaultDaemonTimeout))
+
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		const message = "failed to write request to daemon"
+		logger.ErrorContext(ctx, message,
+			slog.String("path", socketPath),
+			slog.Any("error", err),
+		)
+		err = fmt.Errorf("%s path %s problem %w",
+			message,
+			socketPath,
+			err,
+		)
+		return nil, err
+	}
+
+	var response daemonResponse
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		const message = "failed to read response from daemon"
+		logger.ErrorContext(ctx, message,
+			slog.String("path", socketPath),
+			slog.Any("error", err),
+		)
+		err = fmt.Errorf("%s path %s problem %w",
+			message,
+			socketPath,
+			err,
+		)
+		return nil, err
+	}
+	if response.Error != "" {
+		const message = "daemon failed to evaluate request"
+		logger.ErrorContext(ctx, message,
+			slog.String("path", socketPath),
+			slog.String("error", response.Error),
+		)
+		err = fmt.Errorf("%s path %s problem %s",
+			message,
+			socketPath,
+			response.Error,
+		)
+		return nil, err
+	}
+	if response.Decision == nil {
+		const message = "daemon returned empty decision"
+		logger.ErrorContext(ctx, message,
+			slog.String("path", socketPath),
+		)
+		err = fmt.Errorf("%s path %s", message, socketPath)
+		return nil, err
+	}
+
+	logger.InfoContext(ctx, "decision from daemon",
+		slog.String("path", socketPath),
+		slog.String("decision", response.Decision.String()),
+		slog.String("reason", string(response.Decision.Reason)),
+	)
+
+	return response.Decision, nil
+}
+
+// VerifyDaemon is Verify which asks the daemon for the decision.
+// The error wraps ErrDaemonUnavailable if the daemon cannot be reached, then the caller should Verify in-process.
+func VerifyDaemon(ctx context.Context, logger *slog.Logger, socketPath string, request *Request) (bool, error) {
+	startTime := time.Now()
+
+	decision, err := Ask(ctx, logger, socketPath, request)
+	if errors.Is(err, ErrDaemonUnavailable) {
+		return false, err
+	}
+	return conceal(startTime, decision, err)
+}
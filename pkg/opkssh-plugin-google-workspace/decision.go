@@ -0,0 +1,123 @@
+package opksshplugingoogleworkspace
+
+import (
+	"context"
+	"log/slog"
+)
+
+type (
+	Reason string
+
+	Decision struct {
+		Allow           bool     `json:"allow"`
+		Reason          Reason   `json:"reason"`
+		Tenant          string   `json:"tenant,omitempty"`           // tenant of the request's OAuth application
+		ClientID        string   `json:"client_id,omitempty"`        // matched OAuth application
+		Policy          string   `json:"policy,omitempty"`           // matched principal's key of policy
+		User            string   `json:"user,omitempty"`             // matched user's entry of policy
+		Group           string   `json:"group,omitempty"`            // matched group's email
+		Condition       string   `json:"condition,omitempty"`        // matched condition of policy
+		Rule            *int     `json:"rule,omitempty"`             // index of matched rule
+		RuleDescription string   `json:"rule_description,omitempty"` // description of matched rule
+		Groups          []string `json:"groups,omitempty"`           // consulted groups' emails
+		Stale           bool     `json:"stale,omitempty"`            // based on stale cache, because a refresh failed
+	}
+)
+
+const (
+	ReasonEmailNotVerified     Reason = "email_not_verified"
+	ReasonAudienceMismatch     Reason = "aud_mismatch"
+	ReasonIssuerMismatch       Reason = "iss_mismatch"
+	ReasonHostedDomainMismatch Reason = "hd_mismatch"
+	ReasonNoPolicy             Reason = "no_policy"
+	ReasonClientIDDenied       Reason = "client_id_denied"
+	ReasonDenyUserMatch        Reason = "deny_user_match"
+	ReasonDenyGroupMatch       Reason = "deny_group_match"
+	ReasonDenyConditionMatch   Reason = "deny_condition_match"
+	ReasonUserMatch            Reason = "user_match"
+	ReasonConditionMatch       Reason = "condition_match"
+	ReasonGroupMatch           Reason = "group_match"
+	ReasonNoMatch              Reason = "no_match"
+	ReasonRuleAllow            Reason = "rule_allow"
+	ReasonRuleDeny             Reason = "rule_deny"
+)
+
+var reasonDescriptions = map[Reason]string{
+	ReasonEmailNotVerified:     "email not verified",
+	ReasonAudienceMismatch:     "client_id and aud mismatch",
+	ReasonIssuerMismatch:       "issuer of token is not allowed",
+	ReasonHostedDomainMismatch: "hosted domain of token is not allowed",
+	ReasonNoPolicy:             "principal does not have any policy",
+	ReasonClientIDDenied:       "client_id is not allowed by policy of principal",
+	ReasonDenyUserMatch:        "user's deny policy of principal",
+	ReasonDenyGroupMatch:       "group's deny policy of principal",
+	ReasonDenyConditionMatch:   "condition's deny policy of principal",
+	ReasonUserMatch:            "user's policy of principal",
+	ReasonConditionMatch:       "condition's policy of principal",
+	ReasonGroupMatch:           "group's policy of principal",
+	ReasonNoMatch:              "no policy to allow",
+	ReasonRuleAllow:            "allowed by rule",
+	ReasonRuleDeny:             "denied by rule",
+}
+
+func (r Reason) Description() string {
+	if description, ok := reasonDescriptions[r]; ok {
+		return description
+	}
+	return string(r)
+}
+
+func (d *Decision) String() string {
+	if d.Allow {
+		return "allow"
+	}
+	return "deny"
+}
+
+// log logs the decision, every decision is logged once before it is returned.
+// The decision is marked stale if any answer of the evaluation in ctx was served from stale cache.
+func (d *Decision) log(ctx context.Context, logger *slog.Logger, attrs ...slog.Attr) {
+	d.Stale = isStale(ctx)
+	decision := d.String()
+	message := decision
+	if d.Allow && d.Stale {
+		message = "allowed from stale cache"
+	}
+	attrs = append([]slog.Attr{
+		slog.String("decision", decision),
+		slog.String("reason", string(d.Reason)),
+		slog.String("description", d.Reason.Description()),
+	}, attrs...)
+	if d.ClientID != "" {
+		attrs = append(attrs, slog.String("client_id", d.ClientID))
+	}
+	if d.Policy != "" {
+		attrs = append(attrs, slog.String("policy", d.Policy))
+	}
+	if d.User != "" {
+		attrs = append(attrs, slog.String("user", d.User))
+	}
+	if d.Group != "" {
+		attrs = append(attrs, slog.String("group", d.Group))
+	}
+	if d.Condition != "" {
+		attrs = append(attrs, slog.String("condition", d.Condition))
+	}
+	if d.Rule != nil {
+		attrs = append(attrs, slog.Int("rule", *d.Rule))
+	}
+	if d.RuleDescription != "" {
+		attrs = append(attrs, slog.String("rule_description", d.RuleDescription))
+	}
+	if len(d.Groups) > 0 {
+		attrs = append(attrs, slog.Any("groups", d.Groups))
+	}
+	if d.Stale {
+		attrs = append(attrs, slog.Bool("stale", d.Stale))
+	}
+	level := slog.LevelWarn
+	if d.Allow {
+		level = slog.LevelInfo
+	}
+	logger.LogAttrs(ctx, level, message, attrs...)
+}
@@ -6,5 +6,12 @@ const (
 	DefaultConfigPath    = "/etc/opkssh-plugin-google-workspace/config.yaml"
 	DefaultCachePath     = "/var/cache/opkssh-plugin-google-workspace/cache.json"
 	DefaultLogPath       = "/var/log/opkssh-plugin-google-workspace.log"
+	DefaultSocketPath    = "/run/opkssh-plugin-google-workspace/daemon.sock"
 	DefaultCacheDuration = time.Minute * 15
+	DefaultConcurrency   = 4
+	DefaultDaemonTimeout = time.Second * 30
+	DefaultSCIMTimeout   = time.Second * 30
+	DefaultSCIMAttribute = "displayName"
+	DefaultSCIMBatchSize = 50 // users requested by one filter
+	DefaultIssuer        = "https://accounts.google.com"
 )
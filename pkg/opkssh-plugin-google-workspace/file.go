@@ -0,0 +1,173 @@
+package opksshplugingoogleworkspace
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"log/slog"
+
+	"gopkg.in/yaml.v3"
+)
+
+type (
+	ConfigBackendFile struct {
+		Path string `json:"path" yaml:"path"` // YAML or JSON file with groups, relative to config file
+	}
+
+	// FileFetcher reads members of groups from a static YAML or JSON file.
+	FileFetcher struct {
+		Path string
+	}
+
+	fileGroups struct {
+		Groups map[string][]fileMember `json:"groups" yaml:"groups"`
+	}
+
+	// fileMember is either an email or a mapping with fields of Member
+	fileMember Member
+)
+
+var (
+	_ GroupMembersFetcher = &FileFetcher{}
+)
+
+func init() {
+	RegisterBackend(BackendFile, func(ctx context.Context, logger *slog.Logger, config *Config) (GroupMembersFetcher, error) {
+		if config.Backend.File == nil || config.Backend.File.Path == "" {
+			const message = "path is required for backend"
+			logger.ErrorContext(ctx, message,
+				slog.String("backend", BackendFile),
+			)
+			err := fmt.Errorf("%s %s", message, BackendFile)
+			return nil, err
+		}
+		return NewFileFetcher(config.resolvePath(config.Backend.File.Path)), nil
+	})
+}
+
+func NewFileFetcher(path string) *FileFetcher {
+	return &FileFetcher{
+		Path: path,
+	}
+}
+
+func (m *fileMember) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*m = fileMember{
+			Email:  value.Value,
+			Status: MemberStatusActive,
+			Type:   MemberTypeUser,
+			Role:   MemberRoleMember,
+		}
+		return nil
+	}
+	var plain struct {
+		Id     string `yaml:"id"`
+		Email  string `yaml:"email"`
+		Status string `yaml:"status"`
+		Type   string `yaml:"type"`
+		Role   string `yaml:"role"`
+	}
+	if err := value.Decode(&plain); err != nil {
+		return err
+	}
+	*m = fileMember(plain)
+	if m.Status == "" {
+		m.Status = MemberStatusActive
+	}
+	if m.Type == "" {
+		m.Type = MemberTypeUser
+	}
+	if m.Role == "" {
+		m.Role = MemberRoleMember
+	}
+	return nil
+}
+
+func (ff *FileFetcher) GroupMembers(ctx context.Context, logger *slog.Logger, groupEmail string) ([]*Member, error) {
+	logger.DebugContext(ctx, "read group's members from file",
+		slog.String("path", ff.Path),
+		slog.String("group", groupEmail),
+	)
+
+	// read on every fetch, the file is small and CacheFetcher keeps results
+	data, err := os.ReadFile(ff.Path)
+	if err != nil {
+		const message = "failed to read groups file"
+		logger.ErrorContext(ctx, message,
+			slog.String("path", ff.Path),
+			slog.Any("error", err),
+		)
+		err = fmt.Errorf("%s path %s %w",
+			message,
+			ff.Path,
+			err,
+		)
+		return nil, err
+	}
+
+	// JSON is a subset of YAML
+	var groups fileGroups
+	if err = yaml.Unmarshal(data, &groups); err != nil {
+		const message = "failed to parse groups file"
+		logger.ErrorContext(ctx, message,
+			slog.String("path", ff.Path),
+			slog.Any("error", err),
+		)
+		err = fmt.Errorf("%s path %s %w",
+			message,
+			ff.Path,
+			err,
+		)
+		return nil, err
+	}
+
+	var (
+		members []fileMember
+		found   bool
+	)
+	for key, value := range groups.Groups {
+		if strings.EqualFold(key, groupEmail) {
+			members, found = value, true
+			break
+		}
+	}
+	if !found {
+		const message = "group not found in groups file"
+		logger.ErrorContext(ctx, message,
+			slog.String("path", ff.Path),
+			slog.String("group", groupEmail),
+		)
+		err = fmt.Errorf("%s path %s group %s",
+			message,
+			ff.Path,
+			groupEmail,
+		)
+		return nil, err
+	}
+
+	var set = make(map[string]*Member)
+	for _, member := range members {
+		member := Member(member)
+		set[strings.ToLower(member.Email)] = &member
+	}
+
+	var result = make([]*Member, 0, len(set))
+	for _, member := range set {
+		result = append(result, member)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		left, right := result[i], result[j]
+		return strings.Compare(left.Email, right.Email) < 0
+	})
+
+	logger.InfoContext(ctx, "read group's members from file completed",
+		slog.String("group", groupEmail),
+		slog.Int("members_count", len(result)),
+	)
+
+	return result, nil
+}
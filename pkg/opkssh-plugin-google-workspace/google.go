@@ -2,29 +2,58 @@ package opksshplugingoogleworkspace
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
 
-	"golang.org/x/oauth2/jwt"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
 	admin "google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/impersonate"
 	"google.golang.org/api/option"
 )
 
+const (
+	// CredentialsKeyFile reads credentials from key_file: a service account key or an external account (workload identity federation)
+	CredentialsKeyFile = "key_file"
+	// CredentialsADC uses Application Default Credentials
+	CredentialsADC = "adc"
+	// CredentialsImpersonate uses Application Default Credentials to impersonate the service account through IAM
+	CredentialsImpersonate = "impersonate"
+
+	// LookupMembers lists members of every group of policy
+	LookupMembers = "members"
+	// LookupUserGroups lists groups of the user once and intersects them with groups of policy
+	LookupUserGroups = "user_groups"
+)
+
 type (
 	ConfigGoogleOAuthApp struct {
-		ClientID string `json:"client_id" yaml:"client_id"`
+		ClientID             string   `json:"client_id,omitempty"              yaml:"client_id,omitempty"`
+		ClientIDs            []string `json:"client_ids,omitempty"             yaml:"client_ids,omitempty"`             // more OAuth applications, e.g. while rotating or for CI
+		AllowedIssuers       []string `json:"allowed_issuers,omitempty"        yaml:"allowed_issuers,omitempty"`        // issuers of ID token, DefaultIssuer by default
+		AllowedHostedDomains []string `json:"allowed_hosted_domains,omitempty" yaml:"allowed_hosted_domains,omitempty"` // hd claims of ID token, any or none by default
 	}
 
 	ConfigGoogleWorkspace struct {
-		CustomerID string `json:"customer_id" yaml:"customer_id"`
+		CustomerID      string   `json:"customer_id"                 yaml:"customer_id"`
+		Lookup          string   `json:"lookup,omitempty"            yaml:"lookup,omitempty"`            // "members" (default) or "user_groups"
+		HasMemberGroups []string `json:"has_member_groups,omitempty" yaml:"has_member_groups,omitempty"` // groups checked by members.hasMember instead of listing
 	}
 
 	ConfigGoogleServiceAccount struct {
-		Email   string      `json:"email"    yaml:"email"`
-		KeyFile string      `json:"key_file" yaml:"key_file"`
-		Key     *jwt.Config `json:"-"        yaml:"-"`
+		Email       string             `json:"email"                 yaml:"email"`
+		Credentials string             `json:"credentials,omitempty" yaml:"credentials,omitempty"` // "key_file" (default), "adc" or "impersonate"
+		KeyFile     string             `json:"key_file,omitempty"    yaml:"key_file,omitempty"`
+		Subject     string             `json:"subject,omitempty"     yaml:"subject,omitempty"` // admin user to impersonate with domain-wide delegation
+		TokenSource oauth2.TokenSource `json:"-"                     yaml:"-"`
+		Scopes      []string           `json:"-"                     yaml:"-"`
 	}
 
 	ConfigGoogle struct {
@@ -34,52 +63,305 @@ type (
 	}
 
 	GoogleFetcher struct {
-		Token *jwt.Config
+		TokenSource    oauth2.TokenSource
+		ServiceAccount string
+		Subject        string
+		TokenKey       string // identity of the token in the token file
+		TokenPath      string // persist access token to the file if not empty
+
+		mutex sync.Mutex
+		svc   *admin.Service // created once and shared by all fetches
 	}
 )
 
 var (
 	_ GroupMembersFetcher = &GoogleFetcher{}
+	_ GroupMemberChecker  = &GoogleFetcher{}
+	_ UserGroupsFetcher   = &GoogleFetcher{}
 )
 
-func NewGooglFetcher(config ConfigGoogleServiceAccount) *GoogleFetcher {
+// Validate checks the service account's settings.
+func (sa ConfigGoogleServiceAccount) Validate() error {
+	switch sa.Credentials {
+	case "", CredentialsKeyFile:
+		if sa.KeyFile == "" {
+			return fmt.Errorf("key_file is required for credentials %s", CredentialsKeyFile)
+		}
+	case CredentialsADC:
+	case CredentialsImpersonate:
+		if sa.Email == "" {
+			return fmt.Errorf("email is required for credentials %s", CredentialsImpersonate)
+		}
+	default:
+		return fmt.Errorf("unknown credentials %q", sa.Credentials)
+	}
+	if sa.Subject != "" {
+		local, domain, ok := strings.Cut(sa.Subject, "@")
+		if !ok || local == "" || domain == "" || strings.Contains(domain, "@") {
+			return fmt.Errorf("invalid subject %q", sa.Subject)
+		}
+	}
+	return nil
+}
+
+// load creates the token source of the service account for scopes, relative key_file is resolved against the config's directory.
+func (sa *ConfigGoogleServiceAccount) load(ctx context.Context, logger *slog.Logger, pathConfig string, scopes []string) error {
+	if sa.Credentials == "" {
+		sa.Credentials = CredentialsKeyFile
+	}
+	sa.Scopes = scopes
+
+	// token sources outlive ctx of loading
+	background := context.WithoutCancel(ctx)
+	params := google.CredentialsParams{
+		Scopes:  scopes,
+		Subject: sa.Subject,
+	}
+
+	switch sa.Credentials {
+	case CredentialsKeyFile:
+		// get absolute path to servire account key file
+		serviceAccountKeyPath := sa.KeyFile
+		if !filepath.IsAbs(serviceAccountKeyPath) {
+			serviceAccountKeyPath = filepath.Join(
+				filepath.Dir(pathConfig),
+				serviceAccountKeyPath,
+			)
+		}
+
+		// load service account key file
+		logger.DebugContext(ctx, "read service account file",
+			slog.String("path", serviceAccountKeyPath),
+		)
+		data, err := os.ReadFile(serviceAccountKeyPath)
+		if err != nil {
+			const message = "failed to read service account file"
+			logger.ErrorContext(ctx, message,
+				slog.String("path", serviceAccountKeyPath),
+				slog.Any("error", err),
+			)
+			err = fmt.Errorf("%s path %s %w",
+				message,
+				pathConfig,
+				err,
+			)
+			return err
+		}
+
+		// parse service account key file
+		logger.DebugContext(ctx, "parse service account file",
+			slog.String("path", serviceAccountKeyPath),
+		)
+		credentials, err := google.CredentialsFromJSONWithParams(background, data, params)
+		if err == nil {
+			err = sa.checkCredentials(ctx, logger, credentials)
+		}
+		if err != nil {
+			const message = "failed to parse Google Service Account key file"
+			logger.ErrorContext(ctx, message,
+				slog.String("path", serviceAccountKeyPath),
+				slog.Any("error", err),
+			)
+			err = fmt.Errorf("%s path %s %w",
+				message,
+				pathConfig,
+				err,
+			)
+			return err
+		}
+		sa.TokenSource = credentials.TokenSource
+
+	case CredentialsADC:
+		logger.DebugContext(ctx, "find application default credentials")
+		credentials, err := google.FindDefaultCredentialsWithParams(background, params)
+		if err == nil {
+			err = sa.checkCredentials(ctx, logger, credentials)
+		}
+		if err != nil {
+			const message = "failed to find application default credentials"
+			logger.ErrorContext(ctx, message,
+				slog.Any("error", err),
+			)
+			err = fmt.Errorf("%s %w", message, err)
+			return err
+		}
+		sa.TokenSource = credentials.TokenSource
+
+	case CredentialsImpersonate:
+		logger.DebugContext(ctx, "impersonate service account",
+			slog.String("service_account", sa.Email),
+		)
+		// with subject IAM signJwt signs the domain-wide delegation assertion, otherwise IAM generateAccessToken is used
+		tokenSource, err := impersonate.CredentialsTokenSource(background, impersonate.CredentialsConfig{
+			TargetPrincipal: sa.Email,
+			Scopes:          scopes,
+			Subject:         sa.Subject,
+		})
+		if err != nil {
+			const message = "failed to impersonate service account"
+			logger.ErrorContext(ctx, message,
+				slog.String("service_account", sa.Email),
+				slog.Any("error", err),
+			)
+			err = fmt.Errorf("%s %s %w", message, sa.Email, err)
+			return err
+		}
+		sa.TokenSource = tokenSource
+	}
+
+	logger.DebugContext(ctx, "load service account completed",
+		slog.String("credentials", sa.Credentials),
+		slog.String("service_account", sa.Email),
+		slog.String("subject", sa.Subject),
+	)
+
+	return nil
+}
+
+// checkCredentials verifies that credentials of file can impersonate subject and fills the service account's email.
+func (sa *ConfigGoogleServiceAccount) checkCredentials(ctx context.Context, logger *slog.Logger, credentials *google.Credentials) error {
+	if credentials.JSON == nil {
+		// e.g. metadata server
+		if sa.Subject != "" {
+			return fmt.Errorf("subject requires a service account key file or credentials %s", CredentialsImpersonate)
+		}
+		return nil
+	}
+
+	var file struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+	}
+	if err := json.Unmarshal(credentials.JSON, &file); err != nil {
+		return err
+	}
+	if sa.Subject != "" && file.Type != "service_account" {
+		return fmt.Errorf("subject requires a service account key file or credentials %s, got %s", CredentialsImpersonate, file.Type)
+	}
+	if file.ClientEmail == "" {
+		return nil
+	}
+	if sa.Email == "" {
+		sa.Email = file.ClientEmail
+	} else if sa.Email != file.ClientEmail {
+		logger.WarnContext(ctx, "service account email does not match credentials",
+			slog.String("email", sa.Email),
+			slog.String("key_email", file.ClientEmail),
+		)
+	}
+	return nil
+}
+
+// Scopes returns OAuth scopes which the service account needs for the workspace's lookup.
+func (w ConfigGoogleWorkspace) Scopes() []string {
+	scopes := []string{admin.AdminDirectoryGroupMemberReadonlyScope}
+	if w.Lookup == LookupUserGroups {
+		scopes = append(scopes, admin.AdminDirectoryGroupReadonlyScope)
+	}
+	return scopes
+}
+
+// AllClientIDs returns client_id followed by client_ids.
+func (o ConfigGoogleOAuthApp) AllClientIDs() []string {
+	if o.ClientID == "" {
+		return o.ClientIDs
+	}
+	return append([]string{o.ClientID}, o.ClientIDs...)
+}
+
+// userGroupsLookup reports whether the group is resolved from groups of the user instead of listing its members.
+// groups.list returns only direct memberships and no member's ID, status, type or role, so deny groups,
+// groups with roles and groups of a policy which does not explicitly allow every member (only ACTIVE by default)
+// are always resolved by listing members.
+func (w ConfigGoogleWorkspace) userGroupsLookup(group PolicyGroup, policy *PolicyPrincipal, deny bool) bool {
+	return w.Lookup == LookupUserGroups && !deny && len(group.Roles) == 0 && policy.AllowAnyMember()
+}
+
+func init() {
+	RegisterBackend(BackendGoogle, func(ctx context.Context, logger *slog.Logger, config *Config) (GroupMembersFetcher, error) {
+		return NewGooglFetcher(config.Google.ServiceAccount, *config.Cache), nil
+	})
+}
+
+func NewGooglFetcher(config ConfigGoogleServiceAccount, cache ConfigCache) *GoogleFetcher {
+	var tokenPath string
+	if cache.TokenPath != nil {
+		tokenPath = *cache.TokenPath
+	}
 	return &GoogleFetcher{
-		Token: config.Key,
+		TokenSource:    config.TokenSource,
+		ServiceAccount: config.Email,
+		Subject:        config.Subject,
+		TokenKey:       strings.Join(slices.Concat([]string{config.Credentials, config.Email, config.Subject}, config.Scopes), " "),
+		TokenPath:      tokenPath,
 	}
 }
 
-func (gf *GoogleFetcher) GroupMembers(ctx context.Context, logger *slog.Logger, groupEmail string) ([]*Member, error) {
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+// logger adds the impersonated subject to log context.
+func (gf *GoogleFetcher) logger(logger *slog.Logger) *slog.Logger {
+	if gf.Subject == "" {
+		return logger
+	}
+	return logger.With(slog.String("subject", gf.Subject))
+}
+
+func (gf *GoogleFetcher) service(ctx context.Context, logger *slog.Logger) (*admin.Service, error) {
+	gf.mutex.Lock()
+	defer gf.mutex.Unlock()
+	if gf.svc != nil {
+		return gf.svc, nil
+	}
 
 	logger.DebugContext(ctx, "create Google Workspace Admin Service",
-		slog.Any("service_account", gf.Token.Email),
+		slog.Any("service_account", gf.ServiceAccount),
 	)
 
-	svc, err := admin.NewService(ctx,
-		option.WithTokenSource(gf.Token.TokenSource(ctx)),
-		option.WithScopes(admin.AdminDirectoryGroupMemberReadonlyScope),
+	// the service outlives ctx of the first fetch
+	background := context.WithoutCancel(ctx)
+	tokenSource := gf.TokenSource
+	if gf.TokenPath != "" {
+		tokenSource = newFileTokenSource(background, logger, gf.TokenPath, gf.TokenKey, tokenSource)
+	}
+	tokenSource = oauth2.ReuseTokenSource(nil, tokenSource)
+
+	svc, err := admin.NewService(background,
+		option.WithTokenSource(tokenSource),
 	)
 	if err != nil {
 		const message = "failed to create Google Workspace Admin Service"
 		logger.ErrorContext(ctx,
 			message,
-			slog.Any("service_account", gf.Token.Email),
+			slog.Any("service_account", gf.ServiceAccount),
 			slog.Any("error", err),
 		)
 		err = fmt.Errorf("%s service account %s %w",
 			message,
-			gf.Token.Email,
+			gf.ServiceAccount,
 			err,
 		)
 		return nil, err
 	}
 
+	gf.svc = svc
+	return svc, nil
+}
+
+func (gf *GoogleFetcher) GroupMembers(ctx context.Context, logger *slog.Logger, groupEmail string) ([]*Member, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	logger = gf.logger(logger)
+
+	svc, err := gf.service(ctx, logger)
+	if err != nil {
+		return nil, err
+	}
+
 	call := svc.Members.List(groupEmail)
 	call = call.IncludeDerivedMembership(true)
 
 	logger.DebugContext(ctx, "fetch group's members",
-		slog.Any("service_account", gf.Token.Email),
+		slog.Any("service_account", gf.ServiceAccount),
 		slog.Any("group", groupEmail),
 	)
 
@@ -91,6 +373,7 @@ func (gf *GoogleFetcher) GroupMembers(ctx context.Context, logger *slog.Logger,
 				Email:  member.Email,
 				Status: member.Status,
 				Type:   member.Type,
+				Role:   member.Role,
 			}
 		}
 		return nil
@@ -98,13 +381,13 @@ func (gf *GoogleFetcher) GroupMembers(ctx context.Context, logger *slog.Logger,
 	if err != nil {
 		const message = "failed to fetch group's member"
 		logger.ErrorContext(ctx, message,
-			slog.Any("service_account", gf.Token.Email),
+			slog.Any("service_account", gf.ServiceAccount),
 			slog.Any("group", groupEmail),
 			slog.Any("error", err),
 		)
 		err = fmt.Errorf("%s service account %s group %s %w",
 			message,
-			gf.Token.Email,
+			gf.ServiceAccount,
 			groupEmail,
 			err,
 		)
@@ -127,3 +410,104 @@ func (gf *GoogleFetcher) GroupMembers(ctx context.Context, logger *slog.Logger,
 
 	return result, nil
 }
+
+func (gf *GoogleFetcher) HasMember(ctx context.Context, logger *slog.Logger, groupEmail string, userEmail string) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	logger = gf.logger(logger)
+
+	svc, err := gf.service(ctx, logger)
+	if err != nil {
+		return false, err
+	}
+
+	logger.DebugContext(ctx, "check group's member",
+		slog.Any("service_account", gf.ServiceAccount),
+		slog.Any("group", groupEmail),
+		slog.Any("email", userEmail),
+	)
+
+	result, err := svc.Members.HasMember(groupEmail, userEmail).Context(ctx).Do()
+	if err != nil {
+		const message = "failed to check group's member"
+		logger.ErrorContext(ctx, message,
+			slog.Any("service_account", gf.ServiceAccount),
+			slog.Any("group", groupEmail),
+			slog.Any("email", userEmail),
+			slog.Any("error", err),
+		)
+		err = fmt.Errorf("%s service account %s group %s email %s %w",
+			message,
+			gf.ServiceAccount,
+			groupEmail,
+			userEmail,
+			err,
+		)
+		return false, err
+	}
+
+	logger.InfoContext(ctx, "check group's member completed",
+		slog.String("group", groupEmail),
+		slog.String("email", userEmail),
+		slog.Bool("is_member", result.IsMember),
+	)
+
+	return result.IsMember, nil
+}
+
+func (gf *GoogleFetcher) UserGroups(ctx context.Context, logger *slog.Logger, userEmail string) ([]string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	logger = gf.logger(logger)
+
+	svc, err := gf.service(ctx, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	call := svc.Groups.List()
+	call = call.UserKey(userEmail)
+
+	logger.DebugContext(ctx, "fetch user's groups",
+		slog.Any("service_account", gf.ServiceAccount),
+		slog.Any("email", userEmail),
+	)
+
+	var set = make(map[string]struct{})
+	err = call.Pages(ctx, func(groups *admin.Groups) error {
+		for _, group := range groups.Groups {
+			set[group.Email] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		const message = "failed to fetch user's groups"
+		logger.ErrorContext(ctx, message,
+			slog.Any("service_account", gf.ServiceAccount),
+			slog.Any("email", userEmail),
+			slog.Any("error", err),
+		)
+		err = fmt.Errorf("%s service account %s email %s %w",
+			message,
+			gf.ServiceAccount,
+			userEmail,
+			err,
+		)
+		return nil, err
+	}
+
+	var result = make([]string, 0, len(set))
+	for groupEmail := range set {
+		result = append(result, groupEmail)
+	}
+	sort.Strings(result)
+
+	logger.InfoContext(ctx, "fetch user's groups completed",
+		slog.String("email", userEmail),
+		slog.Int("groups_count", len(result)),
+	)
+
+	return result, nil
+}
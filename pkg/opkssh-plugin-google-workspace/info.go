@@ -2,6 +2,8 @@ package opksshplugingoogleworkspace
 
 import (
 	"maps"
+	"slices"
+	"strings"
 	"time"
 )
 
@@ -12,9 +14,24 @@ type (
 		Members   map[string]*Member `json:"members"`    // user's email => member
 	}
 
+	Membership struct {
+		FetchedAt time.Time `json:"fetched_at"` // fetcher at
+		Group     string    `json:"group"`      // group's email
+		Email     string    `json:"email"`      // user's email
+		IsMember  bool      `json:"is_member"`
+	}
+
+	User struct {
+		FetchedAt time.Time `json:"fetched_at"` // fetcher at
+		Email     string    `json:"email"`      // user's email
+		Groups    []string  `json:"groups"`     // groups' emails
+	}
+
 	Customer struct {
-		CustomerID string            `json:"customer_id"`
-		Groups     map[string]*Group `json:"groups"`
+		CustomerID  string                 `json:"customer_id"`
+		Groups      map[string]*Group      `json:"groups"`
+		Memberships map[string]*Membership `json:"memberships,omitempty"` // "group's email user's email" => membership
+		Users       map[string]*User       `json:"users,omitempty"`       // user's email => user
 	}
 
 	Info struct {
@@ -51,6 +68,7 @@ func (g *Group) AddMember(member *Member) {
 		Email:  member.Email,
 		Status: member.Status,
 		Type:   member.Type,
+		Role:   member.Role,
 	}
 }
 
@@ -94,6 +112,75 @@ func (c *Customer) AddGroup(fetchTime time.Time, groupEmail string) *Group {
 	return group
 }
 
+func (c *Customer) GetMembership(deadline time.Time, groupEmail string, userEmail string) *Membership {
+	if c == nil {
+		return nil
+	}
+	membership := c.Memberships[membershipKey(groupEmail, userEmail)]
+	if membership == nil {
+		return nil
+	}
+	if membership.FetchedAt.Before(deadline) {
+		return nil
+	}
+	return membership
+}
+
+func (c *Customer) AddMembership(fetchTime time.Time, groupEmail string, userEmail string, isMember bool) {
+	if c == nil {
+		panic(nil)
+	}
+	if c.Memberships == nil {
+		c.Memberships = make(map[string]*Membership)
+	}
+	if c.GetMembership(fetchTime, groupEmail, userEmail) != nil {
+		// avoid overwrite more fresh data
+		return
+	}
+	c.Memberships[membershipKey(groupEmail, userEmail)] = &Membership{
+		FetchedAt: fetchTime,
+		Group:     groupEmail,
+		Email:     userEmail,
+		IsMember:  isMember,
+	}
+}
+
+func (c *Customer) GetUser(deadline time.Time, userEmail string) *User {
+	if c == nil {
+		return nil
+	}
+	user := c.Users[strings.ToLower(userEmail)]
+	if user == nil {
+		return nil
+	}
+	if user.FetchedAt.Before(deadline) {
+		return nil
+	}
+	return user
+}
+
+func (c *Customer) AddUser(fetchTime time.Time, userEmail string, groups []string) {
+	if c == nil {
+		panic(nil)
+	}
+	if c.Users == nil {
+		c.Users = make(map[string]*User)
+	}
+	if c.GetUser(fetchTime, userEmail) != nil {
+		// avoid overwrite more fresh data
+		return
+	}
+	c.Users[strings.ToLower(userEmail)] = &User{
+		FetchedAt: fetchTime,
+		Email:     userEmail,
+		Groups:    slices.Clone(groups),
+	}
+}
+
+func membershipKey(groupEmail string, userEmail string) string {
+	return strings.ToLower(groupEmail) + " " + strings.ToLower(userEmail)
+}
+
 func (i *Info) GetCustomer(customerId string) *Customer {
 	if i == nil {
 		return nil
@@ -129,13 +216,23 @@ func (left *Info) Merge(right *Info) {
 		customer := right.Customers[customerId]
 		maps.Keys(customer.Groups)(func(groupEmail string) bool {
 			group := customer.Groups[groupEmail]
+			merged := left.AddCustomer(customerId).AddGroup(group.FetchedAt, group.Email)
 			maps.Keys(group.Members)(func(memberEmail string) bool {
-				member := group.Members[memberEmail]
-				left.AddCustomer(customerId).AddGroup(group.FetchedAt, group.Email).AddMember(member)
+				merged.AddMember(group.Members[memberEmail])
 				return true
 			})
 			return true
 		})
+		maps.Keys(customer.Memberships)(func(key string) bool {
+			membership := customer.Memberships[key]
+			left.AddCustomer(customerId).AddMembership(membership.FetchedAt, membership.Group, membership.Email, membership.IsMember)
+			return true
+		})
+		maps.Keys(customer.Users)(func(userEmail string) bool {
+			user := customer.Users[userEmail]
+			left.AddCustomer(customerId).AddUser(user.FetchedAt, user.Email, user.Groups)
+			return true
+		})
 		return true
 	})
 }
@@ -0,0 +1,117 @@
+package opksshplugingoogleworkspace
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestInfoMergeMemberships(t *testing.T) {
+	older := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+
+	left := &Info{}
+	left.AddCustomer("acme").AddMembership(older, "ops@acme.com", "alice@acme.com", true)
+	left.AddCustomer("acme").AddMembership(newer, "ops@acme.com", "bob@acme.com", false)
+
+	right := &Info{}
+	right.AddCustomer("acme").AddMembership(newer, "ops@acme.com", "alice@acme.com", false)
+	right.AddCustomer("acme").AddMembership(older, "ops@acme.com", "bob@acme.com", true)
+	right.AddCustomer("acme").AddMembership(older, "dev@acme.com", "carol@acme.com", true)
+	right.AddCustomer("globex").AddMembership(older, "ops@acme.com", "alice@acme.com", true)
+
+	left.Merge(right)
+
+	tests := []struct {
+		name     string
+		customer string
+		group    string
+		email    string
+		isMember bool
+		at       time.Time
+	}{
+		{name: "newer replaces older", customer: "acme", group: "ops@acme.com", email: "alice@acme.com", isMember: false, at: newer},
+		{name: "older does not replace newer", customer: "acme", group: "ops@acme.com", email: "bob@acme.com", isMember: false, at: newer},
+		{name: "missing is added", customer: "acme", group: "dev@acme.com", email: "carol@acme.com", isMember: true, at: older},
+		{name: "customers are kept apart", customer: "globex", group: "ops@acme.com", email: "alice@acme.com", isMember: true, at: older},
+		{name: "case-insensitive", customer: "acme", group: "OPS@acme.com", email: "Alice@acme.com", isMember: false, at: newer},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			membership := left.GetCustomer(test.customer).GetMembership(older, test.group, test.email)
+			if membership == nil {
+				t.Fatalf("GetMembership(%q, %q) = nil", test.group, test.email)
+			}
+			if membership.IsMember != test.isMember || !membership.FetchedAt.Equal(test.at) {
+				t.Errorf("GetMembership(%q, %q) = %v at %s, want %v at %s", test.group, test.email, membership.IsMember, membership.FetchedAt, test.isMember, test.at)
+			}
+		})
+	}
+
+	if membership := left.GetCustomer("acme").GetMembership(newer.Add(time.Second), "ops@acme.com", "alice@acme.com"); membership != nil {
+		t.Errorf("GetMembership() of expired membership = %v, want nil", membership)
+	}
+}
+
+func TestInfoMergeUsers(t *testing.T) {
+	older := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+
+	left := &Info{}
+	left.AddCustomer("acme").AddUser(older, "alice@acme.com", []string{"ops@acme.com"})
+	left.AddCustomer("acme").AddUser(newer, "bob@acme.com", []string{"dev@acme.com"})
+
+	right := &Info{}
+	right.AddCustomer("acme").AddUser(newer, "Alice@acme.com", []string{"dev@acme.com"})
+	right.AddCustomer("acme").AddUser(older, "bob@acme.com", []string{"ops@acme.com"})
+	right.AddCustomer("acme").AddUser(older, "carol@acme.com", nil)
+	right.AddCustomer("globex").AddUser(older, "alice@acme.com", []string{"ops@globex.com"})
+
+	left.Merge(right)
+
+	tests := []struct {
+		name     string
+		customer string
+		email    string
+		groups   []string
+		at       time.Time
+	}{
+		{name: "newer replaces older", customer: "acme", email: "alice@acme.com", groups: []string{"dev@acme.com"}, at: newer},
+		{name: "older does not replace newer", customer: "acme", email: "bob@acme.com", groups: []string{"dev@acme.com"}, at: newer},
+		{name: "user without groups is added", customer: "acme", email: "carol@acme.com", groups: nil, at: older},
+		{name: "customers are kept apart", customer: "globex", email: "alice@acme.com", groups: []string{"ops@globex.com"}, at: older},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := left.GetCustomer(test.customer).GetUser(older, test.email)
+			if user == nil {
+				t.Fatalf("GetUser(%q) = nil", test.email)
+			}
+			if !slices.Equal(user.Groups, test.groups) || !user.FetchedAt.Equal(test.at) {
+				t.Errorf("GetUser(%q) = %v at %s, want %v at %s", test.email, user.Groups, user.FetchedAt, test.groups, test.at)
+			}
+		})
+	}
+}
+
+func TestInfoMergeEmptyGroup(t *testing.T) {
+	older := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+
+	left := &Info{}
+	left.AddCustomer("acme").AddGroup(older, "ops@acme.com").AddMember(&Member{Email: "alice@acme.com"})
+
+	// every member is removed in the newer fetch
+	right := &Info{}
+	right.AddCustomer("acme").AddGroup(newer, "ops@acme.com")
+
+	left.Merge(right)
+
+	group := left.GetCustomer("acme").GetGroup(older, "ops@acme.com")
+	if group == nil {
+		t.Fatalf("GetGroup() = nil")
+	}
+	if !group.FetchedAt.Equal(newer) || len(group.Members) != 0 {
+		t.Errorf("GetGroup() = %d members at %s, want no members at %s", len(group.Members), group.FetchedAt, newer)
+	}
+}
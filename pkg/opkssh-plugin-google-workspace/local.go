@@ -0,0 +1,117 @@
+package opksshplugingoogleworkspace
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type (
+	// LocalGroups defines groups in the config file: name of group to its entries.
+	// An entry is either the name of another local group or an user's entry like in users of policy.
+	LocalGroups map[string][]string
+)
+
+// Has reports whether name is a local group.
+func (g LocalGroups) Has(name string) bool {
+	_, ok := g.lookup(name)
+	return ok
+}
+
+func (g LocalGroups) lookup(name string) ([]string, bool) {
+	if entries, ok := g[name]; ok {
+		return entries, true
+	}
+	for key, entries := range g {
+		if strings.EqualFold(key, name) {
+			return entries, true
+		}
+	}
+	return nil, false
+}
+
+// Match returns the user's entry of the local group, including nested local groups, which matches email or user ID.
+func (g LocalGroups) Match(name string, email string, sub string) string {
+	return g.match(name, email, sub, make(map[string]bool))
+}
+
+func (g LocalGroups) match(name string, email string, sub string, visited map[string]bool) string {
+	key := strings.ToLower(name)
+	if visited[key] {
+		return ""
+	}
+	visited[key] = true
+
+	entries, _ := g.lookup(name)
+	for _, entry := range entries {
+		if g.Has(entry) {
+			if matched := g.match(entry, email, sub, visited); matched != "" {
+				return matched
+			}
+			continue
+		}
+		if matchUser(entry, email, sub) {
+			return entry
+		}
+	}
+	return ""
+}
+
+// Validate checks entries of local groups and rejects cycles of nested groups.
+func (g LocalGroups) Validate() error {
+	names := make([]string, 0, len(g))
+	for name := range g {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name == "" {
+			return fmt.Errorf("empty name of local group")
+		}
+		for _, entry := range g[name] {
+			if g.Has(entry) {
+				continue
+			}
+			if err := validateUser(entry); err != nil {
+				return fmt.Errorf("local group %q entry %q %w", name, entry, err)
+			}
+		}
+	}
+
+	// depth-first search, a group on the current path means a cycle
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int)
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		key := strings.ToLower(name)
+		path = append(path, name)
+		switch state[key] {
+		case visiting:
+			return fmt.Errorf("cycle of local groups %s", strings.Join(path, " -> "))
+		case done:
+			return nil
+		}
+		state[key] = visiting
+		entries, _ := g.lookup(name)
+		for _, entry := range entries {
+			if !g.Has(entry) {
+				continue
+			}
+			if err := visit(entry, path); err != nil {
+				return err
+			}
+		}
+		state[key] = done
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package opksshplugingoogleworkspace
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLocalGroupsValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		groups LocalGroups
+		err    string // substring of error, empty if valid
+	}{
+		{
+			name: "nested groups",
+			groups: LocalGroups{
+				"admins":  {"alice@example.com", "ops"},
+				"ops":     {"*@ops.example.com", "oncall"},
+				"oncall":  {"id:42"},
+				"interns": {"domain:intern.example.com"},
+			},
+		},
+		{
+			name: "shared nested group is not a cycle",
+			groups: LocalGroups{
+				"a":      {"b", "c"},
+				"b":      {"shared"},
+				"c":      {"shared"},
+				"shared": {"alice@example.com"},
+			},
+		},
+		{
+			name:   "self reference",
+			groups: LocalGroups{"ops": {"ops"}},
+			err:    "cycle of local groups ops -> ops",
+		},
+		{
+			name: "cycle",
+			groups: LocalGroups{
+				"a": {"b"},
+				"b": {"c"},
+				"c": {"a"},
+			},
+			err: "cycle of local groups a -> b -> c -> a",
+		},
+		{
+			name: "cycle in other case",
+			groups: LocalGroups{
+				"Ops":    {"oncall"},
+				"oncall": {"OPS"},
+			},
+			err: "cycle of local groups",
+		},
+		{
+			name:   "invalid entry",
+			groups: LocalGroups{"ops": {"alice"}},
+			err:    `local group "ops" entry "alice"`,
+		},
+		{
+			name:   "empty name",
+			groups: LocalGroups{"": {"alice@example.com"}},
+			err:    "empty name of local group",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.groups.Validate()
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Validate() = %v, want error %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestLocalGroupsMatch(t *testing.T) {
+	groups := LocalGroups{
+		"admins": {"alice@example.com", "ops"},
+		"ops":    {"*@ops.example.com", "admins"},
+	}
+	tests := []struct {
+		name  string
+		group string
+		email string
+		want  string
+	}{
+		{name: "direct entry", group: "admins", email: "alice@example.com", want: "alice@example.com"},
+		{name: "nested entry", group: "admins", email: "bob@ops.example.com", want: "*@ops.example.com"},
+		{name: "case-insensitive name", group: "ADMINS", email: "alice@example.com", want: "alice@example.com"},
+		{name: "cycle terminates", group: "ops", email: "zed@example.com", want: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := groups.Match(test.group, test.email, ""); got != test.want {
+				t.Errorf("Match(%q, %q) = %q, want %q", test.group, test.email, got, test.want)
+			}
+		})
+	}
+}
@@ -1,10 +1,427 @@
 package opksshplugingoogleworkspace
 
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"gopkg.in/yaml.v3"
+)
+
 type (
 	PolicyPrincipal struct {
-		User  []string `json:"users,omitempty"  yaml:"users,omitempty"`
-		Group []string `json:"groups,omitempty" yaml:"groups,omitempty"`
+		User          []string       `json:"users,omitempty"                  yaml:"users,omitempty"`
+		Group         []PolicyGroup  `json:"groups,omitempty"                 yaml:"groups,omitempty"`
+		DenyUser      []string       `json:"deny_users,omitempty"             yaml:"deny_users,omitempty"`
+		DenyGroup     []PolicyGroup  `json:"deny_groups,omitempty"            yaml:"deny_groups,omitempty"`
+		MemberStatus  []string       `json:"member_statuses,omitempty"        yaml:"member_statuses,omitempty"`        // allowed statuses of group's member, ACTIVE by default
+		MemberType    []string       `json:"member_types,omitempty"           yaml:"member_types,omitempty"`           // allowed types of group's member, any by default
+		ClientIDs     []string       `json:"client_ids,omitempty"             yaml:"client_ids,omitempty"`             // allowed OAuth applications, any of tenants by default
+		HostedDomain  []string       `json:"allowed_hosted_domains,omitempty" yaml:"allowed_hosted_domains,omitempty"` // allowed hd claims of ID token, any or none by default
+		EmailFallback *bool          `json:"email_fallback,omitempty"         yaml:"email_fallback,omitempty"`         // match group's members by email if IDs are unknown, true by default
+		Condition     []string       `json:"conditions,omitempty"             yaml:"conditions,omitempty"`             // CEL expressions which allow
+		DenyCondition []string       `json:"deny_conditions,omitempty"        yaml:"deny_conditions,omitempty"`        // CEL expressions which deny
+		Pattern       *regexp.Regexp `json:"-"                                yaml:"-"`                                // compiled "regex:" principal
+
+		conditionPrograms     []cel.Program // compiled conditions
+		denyConditionPrograms []cel.Program // compiled deny_conditions
+	}
+
+	// PolicyGroup is either group's email or {group: <group's email>, roles: [OWNER, MANAGER, MEMBER]}
+	PolicyGroup struct {
+		Group string   `json:"group"           yaml:"group"`
+		Roles []string `json:"roles,omitempty" yaml:"roles,omitempty"` // any role if empty
 	}
 
 	Policy map[string]*PolicyPrincipal
 )
+
+const (
+	MemberStatusActive    = "ACTIVE"
+	MemberStatusSuspended = "SUSPENDED"
+
+	MemberTypeUser     = "USER"
+	MemberTypeGroup    = "GROUP"
+	MemberTypeCustomer = "CUSTOMER"
+
+	MemberRoleOwner   = "OWNER"
+	MemberRoleManager = "MANAGER"
+	MemberRoleMember  = "MEMBER"
+)
+
+var (
+	// DefaultMemberStatuses is used when the policy of principal does not have member_statuses
+	DefaultMemberStatuses = []string{MemberStatusActive}
+)
+
+const (
+	// PolicyPrincipalDefault is the principal's key of policy which applies to any principal without a better match
+	PolicyPrincipalDefault = "*"
+	// PolicyPrincipalRegexPrefix marks a principal's key which is a regular expression, e.g. "regex:^deploy-[0-9]+$"
+	PolicyPrincipalRegexPrefix = "regex:"
+	// PolicyUserDomainPrefix marks an user's entry which matches every email of the domain, e.g. "domain:company.name"
+	PolicyUserDomainPrefix = "domain:"
+	// PolicyUserIDPrefix marks an user's entry which matches the immutable Google user ID (sub claim), e.g. "id:123456789"
+	PolicyUserIDPrefix = "id:"
+)
+
+// Lookup returns the policy of principal and its key. The precedence is:
+//   - exact principal's key
+//   - patterns, glob (e.g. "deploy-*") or regular expression (e.g. "regex:^deploy-[0-9]+$"),
+//     the longest key first, then in lexicographic order; the first match wins
+//   - default principal's key "*"
+func (p Policy) Lookup(principal string) (string, *PolicyPrincipal) {
+	if policy := p[principal]; policy != nil {
+		return principal, policy
+	}
+
+	patterns := make([]string, 0, len(p))
+	for key := range p {
+		if key != PolicyPrincipalDefault && isPrincipalPattern(key) {
+			patterns = append(patterns, key)
+		}
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		left, right := patterns[i], patterns[j]
+		if len(left) != len(right) {
+			return len(left) > len(right)
+		}
+		return left < right
+	})
+	for _, key := range patterns {
+		if p[key].matchPrincipal(key, principal) {
+			return key, p[key]
+		}
+	}
+
+	if policy := p[PolicyPrincipalDefault]; policy != nil {
+		return PolicyPrincipalDefault, policy
+	}
+
+	return "", nil
+}
+
+// MatchUser returns the first entry of users which matches email or user ID or empty string.
+func (p *PolicyPrincipal) MatchUser(email string, sub string) string {
+	if p == nil {
+		return ""
+	}
+	return matchUsers(p.User, email, sub)
+}
+
+// MatchDenyUser returns the first entry of deny_users which matches email or user ID or empty string.
+func (p *PolicyPrincipal) MatchDenyUser(email string, sub string) string {
+	if p == nil {
+		return ""
+	}
+	return matchUsers(p.DenyUser, email, sub)
+}
+
+// MatchCondition returns the first of conditions which is true for variables or empty string.
+// A condition which fails to evaluate does not match, its error is returned.
+func (p *PolicyPrincipal) MatchCondition(variables map[string]any) (string, error) {
+	if p == nil {
+		return "", nil
+	}
+	return matchConditions(p.Condition, p.conditionPrograms, variables)
+}
+
+// MatchDenyCondition returns the first of deny_conditions which is true for variables or empty string.
+// A condition which fails to evaluate does not match, its error is returned, so the caller can deny.
+func (p *PolicyPrincipal) MatchDenyCondition(variables map[string]any) (string, error) {
+	if p == nil {
+		return "", nil
+	}
+	return matchConditions(p.DenyCondition, p.denyConditionPrograms, variables)
+}
+
+// AllowAnyMember reports whether the policy explicitly allows group's members of every status and type by email,
+// so a lookup which does not return member's status, type and ID cannot allow more than the policy does.
+func (p *PolicyPrincipal) AllowAnyMember() bool {
+	if p == nil {
+		return false
+	}
+	return containsFold(p.MemberStatus, MemberStatusActive) && containsFold(p.MemberStatus, MemberStatusSuspended) &&
+		p.MemberType == nil && (p.EmailFallback == nil || *p.EmailFallback)
+}
+
+// MatchMember reports whether group's member is the user.
+// The user ID is preferred, email is compared only if either ID is unknown and email fallback is enabled.
+func (p *PolicyPrincipal) MatchMember(member *Member, email string, sub string) bool {
+	if sub != "" && member.Id != "" {
+		return member.Id == sub
+	}
+	if p != nil && p.EmailFallback != nil && !*p.EmailFallback {
+		return false
+	}
+	return strings.EqualFold(member.Email, email)
+}
+
+// matchDenyMember reports whether a member of a deny group is the user.
+// Either the user ID or email is enough, regardless of email fallback, so a deny does not fail open for members without ID.
+func matchDenyMember(member *Member, email string, sub string) bool {
+	if sub != "" && member.Id != "" && member.Id == sub {
+		return true
+	}
+	return strings.EqualFold(member.Email, email)
+}
+
+// AllowClientID reports whether the policy accepts tokens of the OAuth application clientID.
+func (p *PolicyPrincipal) AllowClientID(clientID string) bool {
+	return len(p.ClientIDs) == 0 || slices.Contains(p.ClientIDs, clientID)
+}
+
+// AllowHostedDomain reports whether the policy accepts ID tokens with the hd claim.
+// A token without hd, e.g. of a personal Gmail account, is rejected if the policy has allowed hosted domains.
+func (p *PolicyPrincipal) AllowHostedDomain(hostedDomain string) bool {
+	return len(p.HostedDomain) == 0 || (hostedDomain != "" && containsFold(p.HostedDomain, hostedDomain))
+}
+
+// AllowMember reports whether group's member passes the status and type filters of policy.
+func (p *PolicyPrincipal) AllowMember(member *Member) bool {
+	if p == nil || member == nil {
+		return false
+	}
+	statuses := p.MemberStatus
+	if statuses == nil {
+		statuses = DefaultMemberStatuses
+	}
+	if !containsFold(statuses, member.Status) {
+		return false
+	}
+	if p.MemberType != nil && !containsFold(p.MemberType, member.Type) {
+		return false
+	}
+	return true
+}
+
+// Validate checks the policy of principal and compiles the principal's key if it is a regular expression.
+func (p *PolicyPrincipal) Validate(principal string) error {
+	if p == nil {
+		return nil
+	}
+	pattern, err := compilePrincipal(principal)
+	if err != nil {
+		return err
+	}
+	p.Pattern = pattern
+	for _, entry := range p.User {
+		if err := validateUser(entry); err != nil {
+			return fmt.Errorf("user %q %w", entry, err)
+		}
+	}
+	for _, entry := range p.DenyUser {
+		if err := validateUser(entry); err != nil {
+			return fmt.Errorf("deny user %q %w", entry, err)
+		}
+	}
+	for _, group := range p.Group {
+		if err := group.Validate(); err != nil {
+			return fmt.Errorf("group %q %w", group.Group, err)
+		}
+	}
+	for _, group := range p.DenyGroup {
+		if err := group.Validate(); err != nil {
+			return fmt.Errorf("deny group %q %w", group.Group, err)
+		}
+	}
+	for _, status := range p.MemberStatus {
+		if status == "" {
+			return fmt.Errorf("empty member status")
+		}
+	}
+	for _, memberType := range p.MemberType {
+		if !containsFold([]string{MemberTypeUser, MemberTypeGroup, MemberTypeCustomer}, memberType) {
+			return fmt.Errorf("unknown member type %q", memberType)
+		}
+	}
+	programs, err := compileConditions(p.Condition)
+	if err != nil {
+		return err
+	}
+	p.conditionPrograms = programs
+	programs, err = compileConditions(p.DenyCondition)
+	if err != nil {
+		return fmt.Errorf("deny %w", err)
+	}
+	p.denyConditionPrograms = programs
+	return nil
+}
+
+// AllowMember reports whether group's member has one of the roles of policy.
+func (g PolicyGroup) AllowMember(member *Member) bool {
+	if member == nil {
+		return false
+	}
+	return len(g.Roles) == 0 || containsFold(g.Roles, member.Role)
+}
+
+// Validate checks the group of policy.
+func (g PolicyGroup) Validate() error {
+	if g.Group == "" {
+		return fmt.Errorf("empty group")
+	}
+	for _, role := range g.Roles {
+		if !containsFold([]string{MemberRoleOwner, MemberRoleManager, MemberRoleMember}, role) {
+			return fmt.Errorf("unknown role %q", role)
+		}
+	}
+	return nil
+}
+
+func (g *PolicyGroup) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*g = PolicyGroup{Group: value.Value}
+		return nil
+	}
+	type plain PolicyGroup
+	return value.Decode((*plain)(g))
+}
+
+func (g *PolicyGroup) UnmarshalJSON(data []byte) error {
+	var groupEmail string
+	if err := json.Unmarshal(data, &groupEmail); err == nil {
+		*g = PolicyGroup{Group: groupEmail}
+		return nil
+	}
+	type plain PolicyGroup
+	return json.Unmarshal(data, (*plain)(g))
+}
+
+func sortGroups(groups []PolicyGroup) {
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].Group < groups[j].Group
+	})
+}
+
+func (p *PolicyPrincipal) matchPrincipal(key string, principal string) bool {
+	return matchPrincipal(key, p.Pattern, principal)
+}
+
+// compilePrincipal checks the principal's key and compiles it if it is a regular expression.
+func compilePrincipal(principal string) (*regexp.Regexp, error) {
+	if expression, ok := strings.CutPrefix(principal, PolicyPrincipalRegexPrefix); ok {
+		pattern, err := regexp.Compile(`^(?:` + expression + `)$`)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q %w", expression, err)
+		}
+		return pattern, nil
+	}
+	if _, err := path.Match(principal, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %q %w", principal, err)
+	}
+	return nil, nil
+}
+
+// matchPrincipal matches principal against the principal's key, pattern is the compiled "regex:" key.
+func matchPrincipal(key string, pattern *regexp.Regexp, principal string) bool {
+	if strings.HasPrefix(key, PolicyPrincipalRegexPrefix) {
+		return pattern != nil && pattern.MatchString(principal)
+	}
+	matched, err := path.Match(key, principal)
+	return err == nil && matched
+}
+
+func matchUsers(entries []string, email string, sub string) string {
+	for _, entry := range entries {
+		if matchUser(entry, email, sub) {
+			return entry
+		}
+	}
+	return ""
+}
+
+// matchUser matches email or user ID against an user's entry of policy:
+//   - "id:123456789" matches the user ID (sub claim)
+//   - "domain:company.name" matches every email of the domain
+//   - "sre-*@company.name" or "*@company.name" is a glob pattern, local part and domain are matched separately
+//   - anything else must be equal to email
+//
+// The comparison of emails is case-insensitive.
+func matchUser(entry string, email string, sub string) bool {
+	if id, ok := strings.CutPrefix(entry, PolicyUserIDPrefix); ok {
+		return sub != "" && id == sub
+	}
+
+	entry = strings.ToLower(entry)
+	email = strings.ToLower(email)
+
+	emailLocal, emailDomain, ok := strings.Cut(email, "@")
+	if !ok {
+		return false
+	}
+
+	if domain, ok := strings.CutPrefix(entry, PolicyUserDomainPrefix); ok {
+		return domain == emailDomain
+	}
+
+	if !isPattern(entry) {
+		return entry == email
+	}
+
+	entryLocal, entryDomain, ok := strings.Cut(entry, "@")
+	if !ok {
+		return false
+	}
+	localMatched, err := path.Match(entryLocal, emailLocal)
+	if err != nil || !localMatched {
+		return false
+	}
+	domainMatched, err := path.Match(entryDomain, emailDomain)
+	if err != nil || !domainMatched {
+		return false
+	}
+	return true
+}
+
+func validateUser(entry string) error {
+	if id, ok := strings.CutPrefix(entry, PolicyUserIDPrefix); ok {
+		if id == "" || strings.ContainsAny(id, "@*?[") {
+			return fmt.Errorf("invalid user ID %q", id)
+		}
+		return nil
+	}
+
+	if domain, ok := strings.CutPrefix(entry, PolicyUserDomainPrefix); ok {
+		if domain == "" || strings.Contains(domain, "@") || isPattern(domain) {
+			return fmt.Errorf("invalid domain %q", domain)
+		}
+		return nil
+	}
+
+	local, domain, ok := strings.Cut(entry, "@")
+	if !ok || local == "" || domain == "" || strings.Contains(domain, "@") {
+		return fmt.Errorf("invalid email")
+	}
+
+	if _, err := path.Match(local, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q %w", local, err)
+	}
+	if _, err := path.Match(domain, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q %w", domain, err)
+	}
+
+	return nil
+}
+
+func isPattern(value string) bool {
+	return strings.ContainsAny(value, `*?[\`)
+}
+
+func isPrincipalPattern(key string) bool {
+	return strings.HasPrefix(key, PolicyPrincipalRegexPrefix) || isPattern(key)
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
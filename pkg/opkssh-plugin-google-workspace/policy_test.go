@@ -0,0 +1,98 @@
+package opksshplugingoogleworkspace
+
+import (
+	"testing"
+)
+
+func TestMatchUser(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry string
+		email string
+		sub   string
+		want  bool
+	}{
+		{name: "email", entry: "alice@company.name", email: "alice@company.name", want: true},
+		{name: "email case-insensitive", entry: "Alice@Company.Name", email: "alice@COMPANY.name", want: true},
+		{name: "other email", entry: "alice@company.name", email: "bob@company.name", want: false},
+		{name: "email is not a prefix", entry: "alice@company.name", email: "alice@company.name.evil", want: false},
+		{name: "domain", entry: "domain:company.name", email: "alice@company.name", want: true},
+		{name: "domain case-insensitive", entry: "domain:Company.Name", email: "alice@company.NAME", want: true},
+		{name: "subdomain is other domain", entry: "domain:company.name", email: "alice@sub.company.name", want: false},
+		{name: "domain without email", entry: "domain:company.name", email: "company.name", want: false},
+		{name: "glob local part", entry: "sre-*@company.name", email: "sre-alice@company.name", want: true},
+		{name: "glob local part mismatch", entry: "sre-*@company.name", email: "dev-alice@company.name", want: false},
+		{name: "glob any local part", entry: "*@company.name", email: "alice@company.name", want: true},
+		{name: "glob does not cross @", entry: "*@company.name", email: "alice@evil.com@company.name", want: false},
+		{name: "glob domain", entry: "alice@*.company.name", email: "alice@eu.company.name", want: true},
+		{name: "glob domain mismatch", entry: "alice@*.company.name", email: "alice@company.name", want: false},
+		{name: "id", entry: "id:123456789", email: "alice@company.name", sub: "123456789", want: true},
+		{name: "id ignores email", entry: "id:123456789", email: "renamed@company.name", sub: "123456789", want: true},
+		{name: "other id", entry: "id:123456789", email: "alice@company.name", sub: "987654321", want: false},
+		{name: "id without sub", entry: "id:123456789", email: "alice@company.name", want: false},
+		{name: "id is not email", entry: "id:alice@company.name", email: "alice@company.name", want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := matchUser(test.entry, test.email, test.sub); got != test.want {
+				t.Errorf("matchUser(%q, %q, %q) = %v, want %v", test.entry, test.email, test.sub, got, test.want)
+			}
+		})
+	}
+}
+
+func TestPolicyLookup(t *testing.T) {
+	policy := Policy{
+		"root":                  {},
+		"deploy-*":              {},
+		"deploy-web-*":          {},
+		"regex:^ci-[0-9]+$":     {},
+		"app-?b":                {},
+		"app-b?":                {},
+		PolicyPrincipalDefault:  {},
+		"regex:^(admin|ops)$":   {},
+		"regex:^[a-z]+-backup$": {},
+	}
+	for key, principal := range policy {
+		if err := principal.Validate(key); err != nil {
+			t.Fatalf("Validate(%q) = %v", key, err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		principal string
+		want      string
+	}{
+		{name: "exact", principal: "root", want: "root"},
+		{name: "glob", principal: "deploy-api", want: "deploy-*"},
+		{name: "longest glob first", principal: "deploy-web-1", want: "deploy-web-*"},
+		{name: "regex", principal: "ci-42", want: "regex:^ci-[0-9]+$"},
+		{name: "regex is anchored", principal: "ci-42x", want: PolicyPrincipalDefault},
+		{name: "regex alternation is anchored", principal: "admins", want: PolicyPrincipalDefault},
+		{name: "regex alternation", principal: "ops", want: "regex:^(admin|ops)$"},
+		{name: "longest key first across globs and regexes", principal: "db-backup", want: "regex:^[a-z]+-backup$"},
+		{name: "same length in lexicographic order", principal: "app-bb", want: "app-?b"},
+		{name: "default", principal: "guest", want: PolicyPrincipalDefault},
+		{name: "exact key with glob characters", principal: "deploy-*", want: "deploy-*"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, got := policy.Lookup(test.principal)
+			if key != test.want {
+				t.Errorf("Lookup(%q) key = %q, want %q", test.principal, key, test.want)
+			}
+			if got != policy[test.want] {
+				t.Errorf("Lookup(%q) returned policy of other key than %q", test.principal, test.want)
+			}
+		})
+	}
+
+	t.Run("without default", func(t *testing.T) {
+		policy := Policy{"root": {}}
+		key, got := policy.Lookup("guest")
+		if key != "" || got != nil {
+			t.Errorf("Lookup(%q) = %q, %v, want no policy", "guest", key, got)
+		}
+	})
+}
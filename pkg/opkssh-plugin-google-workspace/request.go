@@ -2,19 +2,39 @@ package opksshplugingoogleworkspace
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"os"
+	"strings"
 
 	"github.com/caarlos0/env/v11"
 )
 
 type (
+	// Request is the environment which opkssh exports to policy plugins.
 	Request struct {
-		Principal     string `env:"OPKSSH_PLUGIN_U"`
-		Email         string `env:"OPKSSH_PLUGIN_EMAIL"`
-		EmailVerified bool   `env:"OPKSSH_PLUGIN_EMAIL_VERIFIED"`
-		ClientID      string `env:"OPKSSH_PLUGIN_AUD"`
+		Principal     string `env:"OPKSSH_PLUGIN_U"              json:"principal"`
+		Email         string `env:"OPKSSH_PLUGIN_EMAIL"          json:"email"`
+		EmailVerified bool   `env:"OPKSSH_PLUGIN_EMAIL_VERIFIED" json:"email_verified"`
+		ClientID      string `env:"OPKSSH_PLUGIN_AUD"            json:"aud"`
+		Issuer        string `env:"OPKSSH_PLUGIN_ISS"            json:"iss,omitempty"`
+		Subject       string `env:"OPKSSH_PLUGIN_SUB"            json:"sub,omitempty"`
+		Expiry        string `env:"OPKSSH_PLUGIN_EXP"            json:"exp,omitempty"`
+		NotBefore     string `env:"OPKSSH_PLUGIN_NBF"            json:"nbf,omitempty"`
+		IssuedAt      string `env:"OPKSSH_PLUGIN_IAT"            json:"iat,omitempty"`
+		TokenID       string `env:"OPKSSH_PLUGIN_JTI"            json:"jti,omitempty"`
+		Groups        string `env:"OPKSSH_PLUGIN_GROUPS"         json:"groups,omitempty"`   // groups claim as exported by opkssh
+		Payload       string `env:"OPKSSH_PLUGIN_PAYLOAD"        json:"payload,omitempty"`  // payload of ID token
+		PublicKey     string `env:"OPKSSH_PLUGIN_K"              json:"k,omitempty"`        // SSH public key of the user
+		KeyType       string `env:"OPKSSH_PLUGIN_T"              json:"t,omitempty"`        // type of SSH public key
+		UserPublicKey string `env:"OPKSSH_PLUGIN_UPK"            json:"upk,omitempty"`      // user's public key of PK token as JWK
+		IDToken       string `env:"OPKSSH_PLUGIN_IDT"            json:"idt,omitempty"`      // raw ID token
+		PKToken       string `env:"OPKSSH_PLUGIN_PKT"            json:"pkt,omitempty"`      // raw PK token
+		UserInfo      string `env:"OPKSSH_PLUGIN_USERINFO"       json:"userinfo,omitempty"` // response of userinfo endpoint
+
+		Claims map[string]any `env:"-" json:"claims,omitempty"` // decoded claims of ID token
 	}
 )
 
@@ -38,7 +58,77 @@ func LoadRequest(ctx context.Context, logger *slog.Logger, environ []string) (*R
 		return nil, err
 	}
 
-	logger.DebugContext(ctx, "request loaded")
+	// claims are optional, the plugin still works with the basic variables
+	plugin.Claims, err = decodeClaims(plugin.IDToken, plugin.Payload)
+	if err != nil {
+		logger.WarnContext(ctx, "failed to decode claims of ID token",
+			slog.Any("error", err),
+		)
+	}
+
+	logger.DebugContext(ctx, "request loaded",
+		slog.String("iss", plugin.Issuer),
+		slog.String("sub", plugin.Subject),
+		slog.Int("claims_count", len(plugin.Claims)),
+	)
 
 	return &plugin, nil
 }
+
+// Iss returns the issuer of ID token.
+func (r *Request) Iss() string {
+	if r.Issuer != "" {
+		return r.Issuer
+	}
+	return r.StringClaim("iss")
+}
+
+// Sub returns the immutable Google user ID.
+func (r *Request) Sub() string {
+	if r.Subject != "" {
+		return r.Subject
+	}
+	return r.StringClaim("sub")
+}
+
+// HostedDomain returns the Google Workspace domain of the user from hd claim, empty for personal accounts.
+func (r *Request) HostedDomain() string {
+	return r.StringClaim("hd")
+}
+
+// StringClaim returns the claim of ID token if it is a string.
+func (r *Request) StringClaim(name string) string {
+	value, _ := r.Claims[name].(string)
+	return value
+}
+
+// decodeClaims decodes the payload of the compact ID token or, without the token, the payload exported by opkssh.
+// The signature is not verified here, opkssh verifies the token before calling plugins.
+func decodeClaims(idToken string, payload string) (map[string]any, error) {
+	if idToken != "" {
+		parts := strings.Split(idToken, ".")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("ID token has %d parts instead of 3", len(parts))
+		}
+		payload = parts[1]
+	}
+	payload = strings.TrimSpace(payload)
+	if payload == "" {
+		return nil, nil
+	}
+
+	data := []byte(payload)
+	if !strings.HasPrefix(payload, "{") {
+		decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(payload, "="))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode payload %w", err)
+		}
+		data = decoded
+	}
+
+	var claims map[string]any
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, fmt.Errorf("failed to parse payload %w", err)
+	}
+	return claims, nil
+}
@@ -0,0 +1,80 @@
+package opksshplugingoogleworkspace
+
+import (
+	"context"
+	"encoding/base64"
+	"log/slog"
+	"testing"
+)
+
+func TestDecodeClaims(t *testing.T) {
+	const payload = `{"iss":"https://accounts.google.com","sub":"42","hd":"example.com","amr":["pwd","mfa"]}`
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	padded := base64.URLEncoding.EncodeToString([]byte(payload))
+
+	tests := []struct {
+		name    string
+		idToken string
+		payload string
+		sub     string // expected sub claim, empty if no claims
+		err     bool
+	}{
+		{name: "ID token", idToken: "header." + encoded + ".signature", sub: "42"},
+		{name: "ID token over payload", idToken: "header." + encoded + ".signature", payload: `{"sub":"43"}`, sub: "42"},
+		{name: "JSON payload", payload: payload, sub: "42"},
+		{name: "base64url payload", payload: encoded, sub: "42"},
+		{name: "padded base64url payload", payload: padded, sub: "42"},
+		{name: "payload with spaces", payload: "\n " + payload + "\n", sub: "42"},
+		{name: "nothing", sub: ""},
+		{name: "ID token of 2 parts", idToken: "header." + encoded, err: true},
+		{name: "invalid base64", payload: "not base64!", err: true},
+		{name: "invalid JSON", payload: "{", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := decodeClaims(test.idToken, test.payload)
+			if (err != nil) != test.err {
+				t.Fatalf("decodeClaims() = %v, want error %v", err, test.err)
+			}
+			if test.err {
+				return
+			}
+			if sub, _ := claims["sub"].(string); sub != test.sub {
+				t.Errorf("decodeClaims() sub = %q, want %q", sub, test.sub)
+			}
+		})
+	}
+}
+
+func TestLoadRequest(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"https://accounts.google.com","sub":"42","hd":"example.com"}`))
+	request, err := LoadRequest(context.Background(), slog.New(slog.DiscardHandler), []string{
+		"OPKSSH_PLUGIN_U=root",
+		"OPKSSH_PLUGIN_EMAIL=alice@example.com",
+		"OPKSSH_PLUGIN_EMAIL_VERIFIED=true",
+		"OPKSSH_PLUGIN_AUD=app",
+		"OPKSSH_PLUGIN_IDT=header." + payload + ".signature",
+	})
+	if err != nil {
+		t.Fatalf("LoadRequest() = %v", err)
+	}
+	if request.Principal != "root" || request.Email != "alice@example.com" || !request.EmailVerified || request.ClientID != "app" {
+		t.Errorf("LoadRequest() = %+v", request)
+	}
+	// iss and sub fall back to claims of the ID token if opkssh does not export them
+	if request.Iss() != "https://accounts.google.com" || request.Sub() != "42" || request.HostedDomain() != "example.com" {
+		t.Errorf("LoadRequest() iss %q sub %q hd %q", request.Iss(), request.Sub(), request.HostedDomain())
+	}
+
+	// an invalid ID token does not fail the request
+	request, err = LoadRequest(context.Background(), slog.New(slog.DiscardHandler), []string{
+		"OPKSSH_PLUGIN_U=root",
+		"OPKSSH_PLUGIN_IDT=invalid",
+	})
+	if err != nil {
+		t.Fatalf("LoadRequest() = %v", err)
+	}
+	if request.Claims != nil {
+		t.Errorf("LoadRequest() claims = %v, want nil", request.Claims)
+	}
+}
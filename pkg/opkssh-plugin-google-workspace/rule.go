@@ -0,0 +1,109 @@
+package opksshplugingoogleworkspace
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/google/cel-go/cel"
+)
+
+const (
+	RuleEffectAllow = "allow"
+	RuleEffectDeny  = "deny"
+)
+
+type (
+	// PolicyRule is an entry of the ordered rules, the first rule which matches the principal and the user decides.
+	PolicyRule struct {
+		Description   string        `json:"description,omitempty"     yaml:"description,omitempty"`
+		Principal     []string      `json:"principals"                yaml:"principals"` // keys like in policy: exact, glob, "regex:" or "*"
+		Effect        string        `json:"effect"                    yaml:"effect"`     // "allow" or "deny"
+		User          []string      `json:"users,omitempty"           yaml:"users,omitempty"`
+		Domain        []string      `json:"domains,omitempty"         yaml:"domains,omitempty"`
+		Group         []PolicyGroup `json:"groups,omitempty"          yaml:"groups,omitempty"`
+		Condition     []string      `json:"conditions,omitempty"      yaml:"conditions,omitempty"`      // CEL expressions, all must be true
+		MemberStatus  []string      `json:"member_statuses,omitempty" yaml:"member_statuses,omitempty"` // allowed statuses of group's member, ACTIVE by default
+		MemberType    []string      `json:"member_types,omitempty"    yaml:"member_types,omitempty"`    // allowed types of group's member, any by default
+		EmailFallback *bool         `json:"email_fallback,omitempty"  yaml:"email_fallback,omitempty"`  // match group's members by email if IDs are unknown, true by default
+
+		patterns          []*regexp.Regexp // compiled "regex:" principals
+		conditionPrograms []cel.Program    // compiled conditions
+		subject           *PolicyPrincipal // users, domains and groups as policy of principal, to share matching
+	}
+)
+
+// Validate checks the rule and compiles its principals and conditions.
+func (r *PolicyRule) Validate() error {
+	if r == nil {
+		return fmt.Errorf("empty rule")
+	}
+	switch r.Effect {
+	case RuleEffectAllow, RuleEffectDeny:
+	default:
+		return fmt.Errorf("unknown effect %q", r.Effect)
+	}
+	if len(r.Principal) == 0 {
+		return fmt.Errorf("empty principals")
+	}
+
+	r.patterns = make([]*regexp.Regexp, 0, len(r.Principal))
+	for _, principal := range r.Principal {
+		pattern, err := compilePrincipal(principal)
+		if err != nil {
+			return err
+		}
+		r.patterns = append(r.patterns, pattern)
+	}
+
+	users := append([]string{}, r.User...)
+	for _, domain := range r.Domain {
+		users = append(users, PolicyUserDomainPrefix+domain)
+	}
+	r.subject = &PolicyPrincipal{
+		User:          users,
+		Group:         r.Group,
+		MemberStatus:  r.MemberStatus,
+		MemberType:    r.MemberType,
+		EmailFallback: r.EmailFallback,
+	}
+	// the subject is checked like a policy of principal which matches anything
+	if err := r.subject.Validate(PolicyPrincipalDefault); err != nil {
+		return err
+	}
+
+	programs, err := compileConditions(r.Condition)
+	if err != nil {
+		return err
+	}
+	r.conditionPrograms = programs
+	return nil
+}
+
+// MatchPrincipal reports whether one of principals of the rule matches principal.
+func (r *PolicyRule) MatchPrincipal(principal string) bool {
+	for index, key := range r.Principal {
+		if matchPrincipal(key, r.patterns[index], principal) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchConditions reports whether all conditions of the rule are true for variables.
+func (r *PolicyRule) MatchConditions(variables map[string]any) (bool, error) {
+	for index, program := range r.conditionPrograms {
+		value, _, err := program.Eval(variables)
+		if err != nil {
+			return false, fmt.Errorf("condition %q %w", r.Condition[index], err)
+		}
+		if matched, ok := value.Value().(bool); !ok || !matched {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// HasSubjects reports whether the rule is limited to some users, domains or groups.
+func (r *PolicyRule) HasSubjects() bool {
+	return len(r.User) > 0 || len(r.Domain) > 0 || len(r.Group) > 0
+}
@@ -0,0 +1,323 @@
+package opksshplugingoogleworkspace
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"log/slog"
+)
+
+const (
+	scimMemberTypeUser  = "User"
+	scimMemberTypeGroup = "Group"
+	scimContentType     = "application/scim+json"
+)
+
+type (
+	ConfigBackendSCIM struct {
+		URL       string `json:"url"                 yaml:"url"`                 // base URL of SCIM 2.0 service, e.g. https://example.com/scim/v2
+		TokenFile string `json:"token_file"          yaml:"token_file"`          // file with bearer token, relative to config file
+		Attribute string `json:"attribute,omitempty" yaml:"attribute,omitempty"` // attribute of group matched against group in policy, default displayName
+	}
+
+	// SCIMFetcher reads members of groups from a SCIM 2.0 service.
+	SCIMFetcher struct {
+		URL       string
+		TokenFile string
+		Attribute string
+		Client    *http.Client
+	}
+
+	scimListResponse struct {
+		Resources []scimGroup `json:"Resources"`
+	}
+
+	scimUserListResponse struct {
+		TotalResults int        `json:"totalResults"`
+		Resources    []scimUser `json:"Resources"`
+	}
+
+	scimGroup struct {
+		Id          string          `json:"id"`
+		DisplayName string          `json:"displayName"`
+		Members     []scimReference `json:"members"`
+	}
+
+	scimReference struct {
+		Value string `json:"value"`
+		Type  string `json:"type"`
+	}
+
+	scimUser struct {
+		Id       string      `json:"id"`
+		UserName string      `json:"userName"`
+		Active   *bool       `json:"active"`
+		Emails   []scimEmail `json:"emails"`
+	}
+
+	scimEmail struct {
+		Value   string `json:"value"`
+		Primary bool   `json:"primary"`
+	}
+)
+
+var (
+	_ GroupMembersFetcher = &SCIMFetcher{}
+)
+
+func init() {
+	RegisterBackend(BackendSCIM, func(ctx context.Context, logger *slog.Logger, config *Config) (GroupMembersFetcher, error) {
+		if config.Backend.SCIM == nil || config.Backend.SCIM.URL == "" {
+			const message = "url is required for backend"
+			logger.ErrorContext(ctx, message,
+				slog.String("backend", BackendSCIM),
+			)
+			err := fmt.Errorf("%s %s", message, BackendSCIM)
+			return nil, err
+		}
+		scim := *config.Backend.SCIM
+		scim.TokenFile = config.resolvePath(scim.TokenFile)
+		return NewSCIMFetcher(scim), nil
+	})
+}
+
+func NewSCIMFetcher(config ConfigBackendSCIM) *SCIMFetcher {
+	attribute := config.Attribute
+	if attribute == "" {
+		attribute = DefaultSCIMAttribute
+	}
+	return &SCIMFetcher{
+		URL:       strings.TrimSuffix(config.URL, "/"),
+		TokenFile: config.TokenFile,
+		Attribute: attribute,
+		Client:    &http.Client{Timeout: DefaultSCIMTimeout},
+	}
+}
+
+func (sf *SCIMFetcher) GroupMembers(ctx context.Context, logger *slog.Logger, groupEmail string) ([]*Member, error) {
+	logger.DebugContext(ctx, "fetch group's members from SCIM",
+		slog.String("url", sf.URL),
+		slog.String("group", groupEmail),
+	)
+
+	query := url.Values{}
+	query.Set("filter", fmt.Sprintf("%s eq %q", sf.Attribute, groupEmail))
+	var list scimListResponse
+	if err := sf.get(ctx, logger, "/Groups?"+query.Encode(), &list); err != nil {
+		return nil, err
+	}
+	if len(list.Resources) != 1 {
+		const message = "failed to find group in SCIM"
+		logger.ErrorContext(ctx, message,
+			slog.String("url", sf.URL),
+			slog.String("group", groupEmail),
+			slog.Int("groups_count", len(list.Resources)),
+		)
+		err := fmt.Errorf("%s url %s group %s found %d",
+			message,
+			sf.URL,
+			groupEmail,
+			len(list.Resources),
+		)
+		return nil, err
+	}
+
+	// resolve nested groups like includeDerivedMembership of Google
+	var (
+		userIds []string
+		visited = make(map[string]bool)
+		queue   = []scimGroup{list.Resources[0]}
+	)
+	visited[list.Resources[0].Id] = true
+	for len(queue) > 0 {
+		group := queue[0]
+		queue = queue[1:]
+		for _, reference := range group.Members {
+			switch reference.Type {
+			case scimMemberTypeGroup:
+				if visited[reference.Value] {
+					continue
+				}
+				visited[reference.Value] = true
+				var nested scimGroup
+				if err := sf.get(ctx, logger, "/Groups/"+url.PathEscape(reference.Value), &nested); err != nil {
+					return nil, err
+				}
+				queue = append(queue, nested)
+			case scimMemberTypeUser, "":
+				if visited[reference.Value] {
+					continue
+				}
+				visited[reference.Value] = true
+				userIds = append(userIds, reference.Value)
+			}
+		}
+	}
+
+	users, err := sf.users(ctx, logger, userIds)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]*Member)
+	for _, user := range users {
+		member := user.member()
+		if member.Email == "" {
+			logger.WarnContext(ctx, "SCIM user without email is skipped",
+				slog.String("group", groupEmail),
+				slog.String("id", user.Id),
+			)
+			continue
+		}
+		set[strings.ToLower(member.Email)] = member
+	}
+
+	var result = make([]*Member, 0, len(set))
+	for _, member := range set {
+		result = append(result, member)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		left, right := result[i], result[j]
+		return strings.Compare(left.Email, right.Email) < 0
+	})
+
+	logger.InfoContext(ctx, "fetch group's members from SCIM completed",
+		slog.String("group", groupEmail),
+		slog.Int("members_count", len(result)),
+	)
+
+	return result, nil
+}
+
+// users reads users by ids with a filter per batch of ids instead of a request per user.
+func (sf *SCIMFetcher) users(ctx context.Context, logger *slog.Logger, ids []string) ([]scimUser, error) {
+	var result []scimUser
+	for start := 0; start < len(ids); start += DefaultSCIMBatchSize {
+		batch := ids[start:min(start+DefaultSCIMBatchSize, len(ids))]
+		filters := make([]string, 0, len(batch))
+		for _, id := range batch {
+			filters = append(filters, fmt.Sprintf("id eq %q", id))
+		}
+		query := url.Values{}
+		query.Set("filter", strings.Join(filters, " or "))
+		query.Set("attributes", "id,userName,active,emails")
+		query.Set("count", strconv.Itoa(len(batch)))
+		// the service may return less users per page than requested
+		for fetched := 0; ; {
+			query.Set("startIndex", strconv.Itoa(fetched+1))
+			var list scimUserListResponse
+			if err := sf.get(ctx, logger, "/Users?"+query.Encode(), &list); err != nil {
+				return nil, err
+			}
+			result = append(result, list.Resources...)
+			fetched += len(list.Resources)
+			if len(list.Resources) == 0 || fetched >= list.TotalResults {
+				break
+			}
+		}
+	}
+	if len(result) < len(ids) {
+		logger.WarnContext(ctx, "SCIM users not found are skipped",
+			slog.Int("users_count", len(ids)),
+			slog.Int("found_count", len(result)),
+		)
+	}
+	return result, nil
+}
+
+func (u *scimUser) member() *Member {
+	status := MemberStatusActive
+	if u.Active != nil && !*u.Active {
+		status = MemberStatusSuspended
+	}
+	email := u.UserName
+	for _, candidate := range u.Emails {
+		if candidate.Primary {
+			email = candidate.Value
+			break
+		}
+	}
+	if !strings.Contains(email, "@") && len(u.Emails) > 0 {
+		email = u.Emails[0].Value
+	}
+	if !strings.Contains(email, "@") {
+		email = ""
+	}
+	// id of SCIM is not the Google user ID, so members are matched by email
+	return &Member{
+		Email:  email,
+		Status: status,
+		Type:   MemberTypeUser,
+		Role:   MemberRoleMember,
+	}
+}
+
+func (sf *SCIMFetcher) get(ctx context.Context, logger *slog.Logger, path string, result any) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, sf.URL+path, nil)
+	if err != nil {
+		const message = "failed to create SCIM request"
+		logger.ErrorContext(ctx, message,
+			slog.String("url", sf.URL+path),
+			slog.Any("error", err),
+		)
+		err = fmt.Errorf("%s url %s %w", message, sf.URL+path, err)
+		return err
+	}
+	request.Header.Set("Accept", scimContentType)
+	if sf.TokenFile != "" {
+		// read on every request, so rotated tokens are picked up
+		token, err := os.ReadFile(sf.TokenFile)
+		if err != nil {
+			const message = "failed to read SCIM token file"
+			logger.ErrorContext(ctx, message,
+				slog.String("path", sf.TokenFile),
+				slog.Any("error", err),
+			)
+			err = fmt.Errorf("%s path %s %w", message, sf.TokenFile, err)
+			return err
+		}
+		request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	response, err := sf.Client.Do(request)
+	if err != nil {
+		const message = "failed to send SCIM request"
+		logger.ErrorContext(ctx, message,
+			slog.String("url", sf.URL+path),
+			slog.Any("error", err),
+		)
+		err = fmt.Errorf("%s url %s %w", message, sf.URL+path, err)
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		const message = "unexpected status of SCIM response"
+		logger.ErrorContext(ctx, message,
+			slog.String("url", sf.URL+path),
+			slog.Int("status", response.StatusCode),
+			slog.String("body", string(body)),
+		)
+		err = fmt.Errorf("%s url %s %w", message, sf.URL+path, &statusError{StatusCode: response.StatusCode})
+		return err
+	}
+
+	if err = json.NewDecoder(response.Body).Decode(result); err != nil {
+		const message = "failed to decode SCIM response"
+		logger.ErrorContext(ctx, message,
+			slog.String("url", sf.URL+path),
+			slog.Any("error", err),
+		)
+		err = fmt.Errorf("%s url %s %w", message, sf.URL+path, err)
+		return err
+	}
+	return nil
+}
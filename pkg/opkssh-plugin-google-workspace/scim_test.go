@@ -0,0 +1,124 @@
+package opksshplugingoogleworkspace
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSCIMFetcherGroupMembers(t *testing.T) {
+	const (
+		usersCount = 120
+		pageSize   = 20 // the service returns less users per page than requested
+	)
+	users := make(map[string]scimUser, usersCount)
+	group := scimGroup{Id: "g1", DisplayName: "devs"}
+	nested := scimGroup{Id: "g2", DisplayName: "nested", Members: []scimReference{{Value: "g1", Type: scimMemberTypeGroup}}}
+	for index := range usersCount {
+		id := fmt.Sprintf("u%d", index)
+		active := index%2 == 0
+		users[id] = scimUser{Id: id, UserName: fmt.Sprintf("user%d@example.com", index), Active: &active}
+		reference := scimReference{Value: id, Type: scimMemberTypeUser}
+		// the second half is resolved through the nested group
+		if index < usersCount/2 {
+			group.Members = append(group.Members, reference)
+		} else {
+			nested.Members = append(nested.Members, reference)
+		}
+	}
+	// a cycle of groups and a duplicated member are resolved once
+	group.Members = append(group.Members, scimReference{Value: "g2", Type: scimMemberTypeGroup}, scimReference{Value: "u0", Type: scimMemberTypeUser})
+
+	idPattern := regexp.MustCompile(`id eq "([^"]*)"`)
+	var (
+		mutex     sync.Mutex
+		requests  int                    // requests of users
+		requested = make(map[string]int) // id => filters of users which request it
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var result any
+		switch {
+		case r.URL.Path == "/Groups":
+			if r.URL.Query().Get("filter") != `displayName eq "devs"` {
+				result = scimListResponse{}
+				break
+			}
+			result = scimListResponse{Resources: []scimGroup{group}}
+		case r.URL.Path == "/Groups/g2":
+			result = nested
+		case r.URL.Path == "/Users":
+			query := r.URL.Query()
+			var found []scimUser
+			matches := idPattern.FindAllStringSubmatch(query.Get("filter"), -1)
+			for _, match := range matches {
+				if user, ok := users[match[1]]; ok {
+					found = append(found, user)
+				}
+			}
+			start, _ := strconv.Atoi(query.Get("startIndex"))
+			end := min(start-1+pageSize, len(found))
+			if len(matches) > DefaultSCIMBatchSize {
+				t.Errorf("filter has %d ids, want at most %d", len(matches), DefaultSCIMBatchSize)
+			}
+			mutex.Lock()
+			requests++
+			if start == 1 {
+				for _, match := range matches {
+					requested[match[1]]++
+				}
+			}
+			mutex.Unlock()
+			result = scimUserListResponse{TotalResults: len(found), Resources: found[start-1 : end]}
+		default:
+			// a request per user is not expected
+			http.Error(w, "unexpected path "+r.URL.Path, http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(result)
+	}))
+	defer server.Close()
+
+	fetcher := NewSCIMFetcher(ConfigBackendSCIM{URL: server.URL})
+	members, err := fetcher.GroupMembers(context.Background(), slog.New(slog.DiscardHandler), "devs")
+	if err != nil {
+		t.Fatalf("GroupMembers() = %v", err)
+	}
+	if len(members) != usersCount {
+		t.Fatalf("GroupMembers() returned %d members, want %d", len(members), usersCount)
+	}
+	for _, member := range members {
+		index, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(member.Email, "user"), "@example.com"))
+		if err != nil {
+			t.Fatalf("GroupMembers() returned unexpected member %q", member.Email)
+		}
+		want := MemberStatusSuspended
+		if index%2 == 0 {
+			want = MemberStatusActive
+		}
+		if member.Status != want {
+			t.Errorf("member %s status = %s, want %s", member.Email, member.Status, want)
+		}
+	}
+
+	// every user is requested once, in batches read page by page
+	for id := range users {
+		if requested[id] != 1 {
+			t.Errorf("user %s requested by %d filters, want 1", id, requested[id])
+		}
+	}
+	wantRequests := 0
+	for remaining := usersCount; remaining > 0; remaining -= DefaultSCIMBatchSize {
+		wantRequests += (min(remaining, DefaultSCIMBatchSize) + pageSize - 1) / pageSize
+	}
+	if requests != wantRequests {
+		t.Errorf("users read by %d requests, want %d", requests, wantRequests)
+	}
+}
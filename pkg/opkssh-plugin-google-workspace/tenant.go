@@ -0,0 +1,84 @@
+package opksshplugingoogleworkspace
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// TenantSeparator separates the tenant's name from the group in a qualified group, e.g. "acme/ops-group@acme.com"
+const TenantSeparator = "/"
+
+type (
+	// ConfigTenant is a Google Workspace with its own OAuth application, service account and customer
+	ConfigTenant struct {
+		Name         string `json:"name" yaml:"name"`
+		ConfigGoogle `yaml:",inline"`
+	}
+
+	// Fetchers maps the tenant's name to the fetcher of its groups
+	Fetchers map[string]GroupMembersFetcher
+)
+
+// Tenant returns a copy of config where Google is the config of the tenant or nil if tenant is unknown.
+func (c *Config) Tenant(name string) *Config {
+	for _, tenant := range c.Tenants {
+		if tenant.Name == name {
+			result := *c
+			result.Google = tenant.ConfigGoogle
+			return &result
+		}
+	}
+	return nil
+}
+
+// TenantByClientID returns the tenant which has the OAuth application clientID.
+func (c *Config) TenantByClientID(clientID string) (*ConfigTenant, bool) {
+	for index := range c.Tenants {
+		if slices.Contains(c.Tenants[index].OAuth.AllClientIDs(), clientID) {
+			return &c.Tenants[index], true
+		}
+	}
+	return nil, false
+}
+
+// SplitGroup returns the tenant and the email of a group in policy.
+// A group without a known tenant's name belongs to the first tenant.
+func (c *Config) SplitGroup(group string) (string, string) {
+	if name, groupEmail, ok := strings.Cut(group, TenantSeparator); ok {
+		for _, tenant := range c.Tenants {
+			if tenant.Name == name {
+				return name, groupEmail
+			}
+		}
+	}
+	if len(c.Tenants) == 0 {
+		return "", group
+	}
+	return c.Tenants[0].Name, group
+}
+
+// validateTenants checks names of tenants, an empty name is allowed only for the single implicit tenant.
+func validateTenants(tenants []ConfigTenant) error {
+	seen := make(map[string]bool)
+	clientIDs := make(map[string]bool)
+	for _, tenant := range tenants {
+		if len(tenants) > 1 && tenant.Name == "" {
+			return fmt.Errorf("empty name of tenant")
+		}
+		if strings.Contains(tenant.Name, TenantSeparator) {
+			return fmt.Errorf("name of tenant %q contains %q", tenant.Name, TenantSeparator)
+		}
+		if seen[tenant.Name] {
+			return fmt.Errorf("duplicated tenant %q", tenant.Name)
+		}
+		seen[tenant.Name] = true
+		for _, clientID := range tenant.OAuth.AllClientIDs() {
+			if clientIDs[clientID] {
+				return fmt.Errorf("duplicated client_id %q of tenant %q", clientID, tenant.Name)
+			}
+			clientIDs[clientID] = true
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package opksshplugingoogleworkspace
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+)
+
+const testTenantsConfig = `
+tenants:
+  - name: acme
+    oauth:
+      client_ids: [acme-app, acme-cli]
+  - name: globex
+    oauth:
+      client_id: globex-app
+backend:
+  type: file
+  file:
+    path: groups.yaml
+policy:
+  root:
+    groups:
+      - ops@acme.com
+      - globex/ops@globex.com
+`
+
+func TestSplitGroup(t *testing.T) {
+	config := loadTestConfig(t, testTenantsConfig)
+	tests := []struct {
+		group      string
+		tenant     string
+		groupEmail string
+	}{
+		{group: "ops@acme.com", tenant: "acme", groupEmail: "ops@acme.com"},
+		{group: "acme/ops@acme.com", tenant: "acme", groupEmail: "ops@acme.com"},
+		{group: "globex/ops@globex.com", tenant: "globex", groupEmail: "ops@globex.com"},
+		{group: "initech/ops@initech.com", tenant: "acme", groupEmail: "initech/ops@initech.com"},
+	}
+	for _, test := range tests {
+		t.Run(test.group, func(t *testing.T) {
+			tenant, groupEmail := config.SplitGroup(test.group)
+			if tenant != test.tenant || groupEmail != test.groupEmail {
+				t.Errorf("SplitGroup(%q) = %q, %q, want %q, %q", test.group, tenant, groupEmail, test.tenant, test.groupEmail)
+			}
+		})
+	}
+}
+
+func TestEvaluateTenants(t *testing.T) {
+	config := loadTestConfig(t, testTenantsConfig)
+	fetchers := Fetchers{
+		"acme": fakeFetcher{
+			"ops@acme.com": {{Email: "alice@acme.com", Status: MemberStatusActive, Type: MemberTypeUser}},
+		},
+		"globex": fakeFetcher{
+			"ops@globex.com": {{Email: "bob@globex.com", Status: MemberStatusActive, Type: MemberTypeUser}},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		clientID string
+		email    string
+		allow    bool
+		reason   Reason
+		tenant   string
+		group    string
+	}{
+		{name: "first tenant", clientID: "acme-app", email: "alice@acme.com", allow: true, reason: ReasonGroupMatch, tenant: "acme", group: "ops@acme.com"},
+		{name: "other client of tenant", clientID: "acme-cli", email: "alice@acme.com", allow: true, reason: ReasonGroupMatch, tenant: "acme", group: "ops@acme.com"},
+		{name: "qualified group of second tenant", clientID: "globex-app", email: "bob@globex.com", allow: true, reason: ReasonGroupMatch, tenant: "globex", group: "globex/ops@globex.com"},
+		{name: "unknown client", clientID: "initech-app", email: "alice@acme.com", reason: ReasonAudienceMismatch},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := &Request{
+				Principal:     "root",
+				Email:         test.email,
+				EmailVerified: true,
+				ClientID:      test.clientID,
+				Issuer:        DefaultIssuer,
+			}
+			decision, err := Evaluate(context.Background(), slog.New(slog.DiscardHandler), fetchers, config, request)
+			if err != nil {
+				t.Fatalf("Evaluate() = %v", err)
+			}
+			if decision.Allow != test.allow || decision.Reason != test.reason {
+				t.Errorf("Evaluate() = %s %s, want %v %s", decision, decision.Reason, test.allow, test.reason)
+			}
+			if decision.Tenant != test.tenant || decision.Group != test.group {
+				t.Errorf("Evaluate() tenant %q group %q, want %q %q", decision.Tenant, decision.Group, test.tenant, test.group)
+			}
+		})
+	}
+}
+
+func TestValidateTenants(t *testing.T) {
+	tests := []struct {
+		name    string
+		tenants []ConfigTenant
+		valid   bool
+	}{
+		{name: "single implicit tenant", tenants: []ConfigTenant{{}}, valid: true},
+		{name: "empty name of several tenants", tenants: []ConfigTenant{{Name: "acme"}, {}}},
+		{name: "separator in name", tenants: []ConfigTenant{{Name: "acme/eu"}}},
+		{name: "duplicated name", tenants: []ConfigTenant{{Name: "acme"}, {Name: "acme"}}},
+		{
+			name: "duplicated client",
+			tenants: []ConfigTenant{
+				{Name: "acme", ConfigGoogle: ConfigGoogle{OAuth: ConfigGoogleOAuthApp{ClientID: "app"}}},
+				{Name: "globex", ConfigGoogle: ConfigGoogle{OAuth: ConfigGoogleOAuthApp{ClientIDs: []string{"app"}}}},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateTenants(test.tenants)
+			if (err == nil) != test.valid {
+				t.Errorf("validateTenants() = %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package opksshplugingoogleworkspace
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/gofrs/flock"
+	"golang.org/x/oauth2"
+)
+
+type (
+	tokenFile struct {
+		// by identity the token belongs to, e.g. service account and scopes, so tenants share the file
+		Tokens map[string]*oauth2.Token `json:"tokens"`
+	}
+
+	// fileTokenSource persists the access token so consecutive plugin invocations skip the token exchange
+	fileTokenSource struct {
+		ctx    context.Context
+		logger *slog.Logger
+		path   string
+		key    string
+		base   oauth2.TokenSource
+
+		mutex sync.Mutex
+		lock  *flock.Flock // tokens of other identities are kept, so writers of the file are serialized
+	}
+)
+
+var (
+	_ oauth2.TokenSource = &fileTokenSource{}
+)
+
+func newFileTokenSource(ctx context.Context, logger *slog.Logger, path string, key string, base oauth2.TokenSource) *fileTokenSource {
+	return &fileTokenSource{
+		ctx:    ctx,
+		logger: logger,
+		path:   path,
+		key:    key,
+		base:   base,
+		lock:   flock.New(path + ".filelock"),
+	}
+}
+
+func (s *fileTokenSource) Token() (*oauth2.Token, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if token := s.load().Tokens[s.key]; token.Valid() {
+		s.logger.DebugContext(s.ctx, "token loaded",
+			slog.String("path", s.path),
+		)
+		return token, nil
+	}
+
+	token, err := s.base.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	// the token is still usable if it cannot be saved
+	_ = s.save(token)
+
+	return token, nil
+}
+
+// load returns tokens of the file, an unreadable file has no tokens.
+func (s *fileTokenSource) load() tokenFile {
+	var external tokenFile
+	raw, err := os.ReadFile(s.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			const message = "failed to read token file"
+			s.logger.ErrorContext(s.ctx, message,
+				slog.String("path", s.path),
+				slog.Any("error", err),
+			)
+		}
+		return external
+	}
+
+	err = json.Unmarshal(raw, &external)
+	if err != nil {
+		const message = "failed to parse token file"
+		s.logger.ErrorContext(s.ctx, message,
+			slog.String("path", s.path),
+			slog.Any("error", err),
+		)
+		return tokenFile{}
+	}
+
+	return external
+}
+
+func (s *fileTokenSource) save(token *oauth2.Token) error {
+	if err := s.lock.Lock(); err != nil {
+		const message = "failed to lock token file"
+		s.logger.ErrorContext(s.ctx, message,
+			slog.String("path", s.path),
+			slog.Any("error", err),
+		)
+		err = fmt.Errorf("%s path %s problem %w", message, s.path, err)
+		return err
+	}
+	defer func() {
+		_ = s.lock.Unlock()
+	}()
+
+	// keep valid tokens of other identities, e.g. of other tenants
+	external := tokenFile{Tokens: make(map[string]*oauth2.Token)}
+	for key, other := range s.load().Tokens {
+		if other.Valid() {
+			external.Tokens[key] = other
+		}
+	}
+	external.Tokens[s.key] = &oauth2.Token{
+		AccessToken: token.AccessToken,
+		TokenType:   token.TokenType,
+		Expiry:      token.Expiry,
+	}
+	raw, err := json.Marshal(&external)
+	if err != nil {
+		const message = "failed to serialize token file"
+		s.logger.ErrorContext(s.ctx, message,
+			slog.Any("error", err),
+		)
+		err = fmt.Errorf("%s %w", message, err)
+		return err
+	}
+
+	parentPath := filepath.Dir(s.path)
+	tempFile, err := os.CreateTemp(parentPath, filepath.Base(s.path)+".*")
+	if err != nil {
+		const message = "failed to create temporary token file"
+		s.logger.ErrorContext(s.ctx, message,
+			slog.String("dir", parentPath),
+			slog.Any("error", err),
+		)
+		err = fmt.Errorf("%s dir %s problem %w", message, parentPath, err)
+		return err
+	}
+	pathTemp := tempFile.Name()
+	defer func() {
+		_ = os.Remove(pathTemp)
+	}()
+
+	// os.CreateTemp creates the file with mode 0600
+	_, err = tempFile.Write(raw)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(pathTemp, s.path)
+	}
+	if err != nil {
+		const message = "failed to write token file"
+		s.logger.ErrorContext(s.ctx, message,
+			slog.String("path", s.path),
+			slog.Any("error", err),
+		)
+		err = fmt.Errorf("%s path %s problem %w", message, s.path, err)
+		return err
+	}
+
+	s.logger.InfoContext(s.ctx, "token saved",
+		slog.String("path", s.path),
+	)
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package opksshplugingoogleworkspace
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// countingTokenSource issues a new token of the identity on every call.
+type countingTokenSource struct {
+	key   string
+	count int
+}
+
+func (s *countingTokenSource) Token() (*oauth2.Token, error) {
+	s.count++
+	return &oauth2.Token{AccessToken: s.key, TokenType: "Bearer", Expiry: time.Now().Add(time.Hour)}, nil
+}
+
+func TestFileTokenSourceTenants(t *testing.T) {
+	logger := slog.New(slog.DiscardHandler)
+	path := filepath.Join(t.TempDir(), "token.json")
+	// a token file of the previous format is ignored
+	if err := os.WriteFile(path, []byte(`{"key":"acme","token":{"access_token":"old"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	acme := &countingTokenSource{key: "acme"}
+	globex := &countingTokenSource{key: "globex"}
+	sources := map[string]*countingTokenSource{"acme": acme, "globex": globex}
+
+	// tenants share the token file, each of them gets its own token once, then reuses it
+	for range 2 {
+		for key, base := range sources {
+			token, err := newFileTokenSource(context.Background(), logger, path, key, base).Token()
+			if err != nil {
+				t.Fatalf("Token() = %v", err)
+			}
+			if token.AccessToken != key {
+				t.Errorf("Token() of %s = %q, want %q", key, token.AccessToken, key)
+			}
+		}
+	}
+	for key, base := range sources {
+		if base.count != 1 {
+			t.Errorf("token of %s issued %d times, want 1", key, base.count)
+		}
+	}
+}
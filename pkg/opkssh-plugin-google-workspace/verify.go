@@ -4,6 +4,9 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"slices"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -13,113 +16,459 @@ type (
 		Email  string `json:"email"` // user's email
 		Status string `json:"status"`
 		Type   string `json:"type"`
+		Role   string `json:"role"`
 	}
 
 	GroupMembersFetcher interface {
 		GroupMembers(ctx context.Context, logger *slog.Logger, groupEmail string) ([]*Member, error)
 	}
+
+	// GroupMemberChecker is implemented by fetchers which can check a single membership without listing the group
+	GroupMemberChecker interface {
+		HasMember(ctx context.Context, logger *slog.Logger, groupEmail string, userEmail string) (bool, error)
+	}
+
+	// UserGroupsFetcher is implemented by fetchers which can list groups of the user
+	UserGroupsFetcher interface {
+		UserGroups(ctx context.Context, logger *slog.Logger, userEmail string) ([]string, error)
+	}
+
+	evaluation struct {
+		logger   *slog.Logger
+		inform   *slog.Logger
+		fetchers Fetchers
+		config   *Config
+		request  *Request
+		decision *Decision
+		mutex    sync.Mutex // guards decision while groups are matched concurrently
+
+		userGroups      map[string][]string // groups of the request's user per tenant, fetched once for LookupUserGroups
+		userGroupsMutex sync.Mutex
+	}
 )
 
-func Verify(ctx context.Context, logger *slog.Logger, fetcher GroupMembersFetcher, config *Config, request *Request) (bool, error) {
+func Verify(ctx context.Context, logger *slog.Logger, fetchers Fetchers, config *Config, request *Request) (bool, error) {
+	startTime := time.Now()
+
+	decision, err := Evaluate(ctx, logger, fetchers, config, request)
+	return conceal(startTime, decision, err)
+}
+
+// conceal converts decision to the plugin's result and delays negative results.
+func conceal(startTime time.Time, decision *Decision, err error) (bool, error) {
+	result := err == nil && decision.Allow
+	if !result {
+		// we need this delay to avoid timing attack based on negative resulsts
+		round := time.Second * 5
+		delay := (time.Since(startTime) + round).Truncate(round)
+		time.Sleep(delay)
+	}
+	return result, err
+}
+
+func Evaluate(ctx context.Context, logger *slog.Logger, fetchers Fetchers, config *Config, request *Request) (*Decision, error) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	ctx, _ = withStaleTracker(ctx)
 
-	startTime := time.Now()
-
-	result, err := func() (bool, error) {
-		inform := logger.With(
+	e := &evaluation{
+		logger: logger,
+		inform: logger.With(
 			slog.String("principal", request.Principal),
 			slog.String("email", request.Email),
 			slog.Bool("email_verified", request.EmailVerified),
 			slog.String("aud", request.ClientID),
+		),
+		fetchers:   fetchers,
+		config:     config,
+		request:    request,
+		decision:   &Decision{},
+		userGroups: make(map[string][]string),
+	}
+	decision := e.decision
+
+	if !request.EmailVerified {
+		decision.Reason = ReasonEmailNotVerified
+		decision.log(ctx, e.inform)
+		return decision, nil
+	}
+
+	// the tenant is selected by the OAuth application of the token
+	tenant, ok := config.TenantByClientID(request.ClientID)
+	if !ok {
+		clientIDs := make([]string, 0, len(config.Tenants))
+		for _, tenant := range config.Tenants {
+			clientIDs = append(clientIDs, tenant.OAuth.AllClientIDs()...)
+		}
+		decision.Reason = ReasonAudienceMismatch
+		decision.log(ctx, e.inform,
+			slog.Any("client_id", clientIDs),
 		)
+		return decision, nil
+	}
+	decision.Tenant = tenant.Name
+	decision.ClientID = request.ClientID
+	if tenant.Name != "" {
+		e.inform = e.inform.With(slog.String("tenant", tenant.Name))
+	}
 
-		if !request.EmailVerified {
-			const decision = "deny"
-			const reason = "email not verified"
-			inform.WarnContext(ctx, decision,
-				slog.String("decision", decision),
-				slog.String("reason", reason),
-			)
-			return false, nil
+	if !slices.Contains(tenant.OAuth.AllowedIssuers, request.Iss()) {
+		decision.Reason = ReasonIssuerMismatch
+		decision.log(ctx, e.inform,
+			slog.String("iss", request.Iss()),
+			slog.Any("allowed_issuers", tenant.OAuth.AllowedIssuers),
+		)
+		return decision, nil
+	}
+
+	hostedDomain := request.HostedDomain()
+	if len(tenant.OAuth.AllowedHostedDomains) > 0 && (hostedDomain == "" || !containsFold(tenant.OAuth.AllowedHostedDomains, hostedDomain)) {
+		decision.Reason = ReasonHostedDomainMismatch
+		decision.log(ctx, e.inform,
+			slog.String("hd", hostedDomain),
+			slog.Any("allowed_hosted_domains", tenant.OAuth.AllowedHostedDomains),
+		)
+		return decision, nil
+	}
+
+	variables := conditionVariables(request, tenant.Name)
+
+	key, policy := config.Policy.Lookup(request.Principal)
+	decision.Policy = key
+
+	// restrictions and denies of the policy of principal take precedence over rules
+	if policy != nil {
+		denied, err := e.denyPolicy(ctx, policy, variables)
+		if err != nil {
+			return nil, err
+		}
+		if denied {
+			return decision, nil
 		}
+	}
 
-		if request.ClientID != config.Google.OAuth.ClientID {
-			const decision = "deny"
-			const reason = "client_id and aud mismatch"
-			inform.WarnContext(ctx, decision,
-				slog.String("decision", decision),
-				slog.String("reason", reason),
-				slog.String("client_id", config.Google.OAuth.ClientID),
-			)
-			return false, nil
+	// ordered rules are evaluated before the allows of the policy of principal, the first matched rule decides
+	for index, rule := range config.Rules {
+		if !rule.MatchPrincipal(request.Principal) {
+			continue
+		}
+		matched, err := e.matchRule(ctx, rule, variables)
+		if err != nil {
+			return nil, err
+		}
+		if !matched {
+			continue
 		}
+		decision.Allow = rule.Effect == RuleEffectAllow
+		decision.Reason = ReasonRuleDeny
+		if decision.Allow {
+			decision.Reason = ReasonRuleAllow
+		}
+		decision.Rule = &index
+		decision.RuleDescription = rule.Description
+		decision.log(ctx, e.inform)
+		return decision, nil
+	}
+
+	if policy == nil {
+		decision.Reason = ReasonNoPolicy
+		decision.log(ctx, e.inform)
+		return decision, nil
+	}
+
+	if userEntry := policy.MatchUser(request.Email, request.Sub()); userEntry != "" {
+		decision.Allow = true
+		decision.Reason = ReasonUserMatch
+		decision.User = userEntry
+		decision.log(ctx, e.inform)
+		return decision, nil
+	}
+
+	// a condition which fails to evaluate does not allow
+	condition, err := policy.MatchCondition(variables)
+	if err != nil {
+		e.inform.WarnContext(ctx, "failed to evaluate condition",
+			slog.Any("error", err),
+		)
+	}
+	if condition != "" {
+		decision.Allow = true
+		decision.Reason = ReasonConditionMatch
+		decision.Condition = condition
+		decision.log(ctx, e.inform)
+		return decision, nil
+	}
+
+	groupEmail, err := e.matchGroups(ctx, policy.Group, policy, false)
+	if err != nil {
+		return nil, err
+	}
+	if groupEmail != "" {
+		decision.Allow = true
+		decision.Reason = ReasonGroupMatch
+		decision.Group = groupEmail
+		decision.log(ctx, e.inform)
+		return decision, nil
+	}
+
+	decision.Reason = ReasonNoMatch
+	decision.log(ctx, e.inform)
+	return decision, nil
+}
+
+// denyPolicy reports whether the request is denied by the policy of principal: by its allowed hosted domains and client IDs,
+// deny users, deny conditions or deny groups. The decision is logged if denied.
+func (e *evaluation) denyPolicy(ctx context.Context, policy *PolicyPrincipal, variables map[string]any) (bool, error) {
+	if !policy.AllowHostedDomain(e.request.HostedDomain()) {
+		e.decision.Reason = ReasonHostedDomainMismatch
+		e.decision.log(ctx, e.inform,
+			slog.String("hd", e.request.HostedDomain()),
+			slog.Any("allowed_hosted_domains", policy.HostedDomain),
+		)
+		return true, nil
+	}
+
+	if !policy.AllowClientID(e.request.ClientID) {
+		e.decision.Reason = ReasonClientIDDenied
+		e.decision.log(ctx, e.inform,
+			slog.Any("client_ids", policy.ClientIDs),
+		)
+		return true, nil
+	}
+
+	// deny takes precedence over allow
+	if userEntry := policy.MatchDenyUser(e.request.Email, e.request.Sub()); userEntry != "" {
+		e.decision.Reason = ReasonDenyUserMatch
+		e.decision.User = userEntry
+		e.decision.log(ctx, e.inform)
+		return true, nil
+	}
+
+	condition, err := policy.MatchDenyCondition(variables)
+	if condition != "" {
+		e.decision.Reason = ReasonDenyConditionMatch
+		e.decision.Condition = condition
+		e.decision.log(ctx, e.inform)
+		return true, nil
+	}
+	if err != nil {
+		// a deny condition which fails to evaluate denies
+		const message = "failed to evaluate deny condition"
+		e.inform.ErrorContext(ctx, message,
+			slog.Any("error", err),
+		)
+		err = fmt.Errorf("%s %w", message, err)
+		return false, err
+	}
 
-		policy := config.Policy[request.Principal]
+	groupEmail, err := e.matchGroups(ctx, policy.DenyGroup, policy, true)
+	if err != nil {
+		return false, err
+	}
+	if groupEmail != "" {
+		e.decision.Reason = ReasonDenyGroupMatch
+		e.decision.Group = groupEmail
+		e.decision.log(ctx, e.inform)
+		return true, nil
+	}
 
-		if policy == nil {
-			const decision = "deny"
-			const reason = "principal does not have any policy"
-			inform.WarnContext(ctx, decision,
-				slog.String("decision", decision),
-				slog.String("reason", reason),
+	return false, nil
+}
+
+// matchRule reports whether the request's user is a subject of the rule and all conditions of the rule are true.
+// A rule without users, domains and groups applies to any user.
+func (e *evaluation) matchRule(ctx context.Context, rule *PolicyRule, variables map[string]any) (bool, error) {
+	matched, err := rule.MatchConditions(variables)
+	if err != nil {
+		if rule.Effect == RuleEffectDeny {
+			// a deny rule which fails to evaluate denies
+			const message = "failed to evaluate condition of deny rule"
+			e.inform.ErrorContext(ctx, message,
+				slog.String("rule_description", rule.Description),
+				slog.Any("error", err),
 			)
-			return false, nil
-		}
-
-		for index := range policy.User {
-			userEmail := policy.User[index]
-			if request.Email == userEmail {
-				const decision = "allow"
-				const reason = "user's policy of principal"
-				inform.InfoContext(ctx, decision,
-					slog.String("decision", decision),
-					slog.String("reason", reason),
-				)
-				return true, nil
+			err = fmt.Errorf("%s %w", message, err)
+			return false, err
+		}
+		e.inform.WarnContext(ctx, "failed to evaluate condition of rule",
+			slog.String("rule_description", rule.Description),
+			slog.Any("error", err),
+		)
+		return false, nil
+	}
+	if !matched {
+		return false, nil
+	}
+	if !rule.HasSubjects() {
+		return true, nil
+	}
+
+	if userEntry := rule.subject.MatchUser(e.request.Email, e.request.Sub()); userEntry != "" {
+		e.decision.User = userEntry
+		return true, nil
+	}
+
+	// like deny_groups, a deny rule applies to every member
+	groupEmail, err := e.matchGroups(ctx, rule.subject.Group, rule.subject, rule.Effect == RuleEffectDeny)
+	if err != nil {
+		return false, err
+	}
+	if groupEmail != "" {
+		e.decision.Group = groupEmail
+		return true, nil
+	}
+	return false, nil
+}
+
+// matchGroups returns the first group, in the order of policy, which has the request's user as a member or empty string.
+// Members of allowed groups are filtered by policy, deny groups apply to every member.
+// Groups are fetched concurrently up to the configured limit, the remaining fetches are cancelled once a group matches.
+func (e *evaluation) matchGroups(ctx context.Context, groups []PolicyGroup, policy *PolicyPrincipal, deny bool) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	matched := make([]bool, len(groups))
+	errs := make([]error, len(groups))
+
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, *e.config.Concurrency)
+	for index := range groups {
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			group := groups[index]
+			e.consult(group.Group)
+			matched[index], errs[index] = e.matchGroup(ctx, group, policy, deny)
+			if matched[index] {
+				cancel()
 			}
+		}(index)
+	}
+	wg.Wait()
+
+	for index := range groups {
+		if matched[index] {
+			return groups[index].Group, nil
+		}
+	}
+
+	for index := range groups {
+		err := errs[index]
+		if err == nil {
+			continue
+		}
+		groupEmail := groups[index].Group
+		const message = "failed to fetch group's members"
+		e.inform.ErrorContext(ctx, message,
+			slog.String("group", groupEmail),
+			slog.Any("error", err),
+		)
+		err = fmt.Errorf("%s group %s %w",
+			message,
+			groupEmail,
+			err,
+		)
+		return "", err
+	}
+
+	return "", nil
+}
+
+func (e *evaluation) consult(groupEmail string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.decision.Groups = append(e.decision.Groups, groupEmail)
+	sort.Strings(e.decision.Groups)
+}
+
+func (e *evaluation) matchGroup(ctx context.Context, group PolicyGroup, policy *PolicyPrincipal, deny bool) (bool, error) {
+	email := e.request.Email
+	var filter func(member *Member) bool
+	if !deny {
+		filter = policy.AllowMember
+	}
+
+	if e.config.Groups.Has(group.Group) {
+		// local groups do not have member's status, type or role, so filters do not apply
+		entry := e.config.Groups.Match(group.Group, email, e.request.Sub())
+		if entry != "" {
+			e.logger.DebugContext(ctx, "local group's entry matched",
+				slog.String("group", group.Group),
+				slog.String("entry", entry),
+			)
+		}
+		return entry != "", nil
+	}
+
+	// the group may belong to another tenant than the request's user
+	tenant, groupEmail := e.config.SplitGroup(group.Group)
+	workspace := e.config.Tenant(tenant).Google.Workspace
+	fetcher, ok := e.fetchers[tenant]
+	if !ok {
+		return false, fmt.Errorf("no fetcher of tenant %q", tenant)
+	}
+
+	if containsFold(workspace.HasMemberGroups, groupEmail) {
+		if checker, ok := fetcher.(GroupMemberChecker); ok {
+			// members.hasMember does not return member's status, type or role, so filters do not apply
+			return checker.HasMember(ctx, e.logger, groupEmail, email)
 		}
+	}
 
-		for index := range policy.Group {
-			groupEmail := policy.Group[index]
-			memberList, err := fetcher.GroupMembers(ctx, logger, groupEmail)
+	if workspace.userGroupsLookup(group, policy, deny) {
+		if _, ok := fetcher.(UserGroupsFetcher); ok {
+			userGroups, err := e.fetchUserGroups(ctx, tenant, fetcher)
 			if err != nil {
-				const message = "failed to fetch group's members"
-				inform.ErrorContext(ctx, message,
-					slog.String("group", groupEmail),
-					slog.Any("error", err),
-				)
-				err = fmt.Errorf("%s group %s %w",
-					message,
-					groupEmail,
-					err,
-				)
 				return false, err
 			}
-			for _, member := range memberList {
-				if request.Email == member.Email {
-					const decision = "allow"
-					const reason = "group's policy of principal"
-					inform.InfoContext(ctx, decision,
-						slog.String("decision", decision),
-						slog.String("reason", reason),
-						slog.String("group", groupEmail),
-					)
-					return true, nil
-				}
-			}
+			return containsFold(userGroups, groupEmail), nil
 		}
+	}
 
-		const message = "deny - no policy to allow"
-		inform.WarnContext(ctx, message)
-		return false, nil
-	}()
-	if !result || err != nil {
-		// we need this delay to avoid timing attack based on negative resulsts
-		round := time.Second * 5
-		delay := (time.Since(startTime) + round).Truncate(round)
-		time.Sleep(delay)
+	memberList, err := fetcher.GroupMembers(ctx, e.logger, groupEmail)
+	if err != nil {
+		return false, err
 	}
-	return result, err
+	match := policy.MatchMember
+	if deny {
+		match = matchDenyMember
+	}
+	for _, member := range memberList {
+		if !match(member, email, e.request.Sub()) {
+			continue
+		}
+		if !group.AllowMember(member) || (filter != nil && !filter(member)) {
+			e.inform.InfoContext(ctx, "group's member filtered out by policy",
+				slog.String("group", groupEmail),
+				slog.String("member_status", member.Status),
+				slog.String("member_type", member.Type),
+				slog.String("member_role", member.Role),
+			)
+			continue
+		}
+		return true, nil
+	}
+	return false, nil
+}
 
+func (e *evaluation) fetchUserGroups(ctx context.Context, tenant string, fetcher GroupMembersFetcher) ([]string, error) {
+	e.userGroupsMutex.Lock()
+	defer e.userGroupsMutex.Unlock()
+	if userGroups, ok := e.userGroups[tenant]; ok {
+		return userGroups, nil
+	}
+	userGroups, err := fetcher.(UserGroupsFetcher).UserGroups(ctx, e.logger, e.request.Email)
+	if err != nil {
+		return nil, err
+	}
+	e.userGroups[tenant] = userGroups
+	return userGroups, nil
 }
@@ -0,0 +1,459 @@
+package opksshplugingoogleworkspace
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeFetcher returns members of groups from memory, an unknown group fails like a deleted group.
+type fakeFetcher map[string][]*Member
+
+var (
+	_ GroupMembersFetcher = fakeFetcher{}
+)
+
+func (f fakeFetcher) GroupMembers(ctx context.Context, logger *slog.Logger, groupEmail string) ([]*Member, error) {
+	members, ok := f[groupEmail]
+	if !ok {
+		return nil, fmt.Errorf("group %s not found", groupEmail)
+	}
+	return members, nil
+}
+
+var testFetcher = fakeFetcher{
+	"devs@example.com": {
+		{Email: "alice@example.com", Status: MemberStatusActive, Type: MemberTypeUser, Role: MemberRoleMember},
+		{Email: "bob@example.com", Status: MemberStatusSuspended, Type: MemberTypeUser, Role: MemberRoleMember},
+		{Id: "7", Email: "carol@example.com", Status: MemberStatusActive, Type: MemberTypeUser, Role: MemberRoleOwner},
+		{Email: "dave@example.com", Status: MemberStatusActive, Type: MemberTypeUser, Role: MemberRoleMember},
+		{Email: "mallory@example.com", Status: MemberStatusActive, Type: MemberTypeUser, Role: MemberRoleMember},
+		{Email: "eve@contractor.com", Status: MemberStatusActive, Type: MemberTypeUser, Role: MemberRoleMember},
+	},
+	"contractors@example.com": {
+		{Email: "dave@example.com", Status: MemberStatusActive, Type: MemberTypeUser, Role: MemberRoleMember},
+	},
+}
+
+// loadTestConfig loads the config from data like it is read from the config file.
+// The backend of the config is never created, tests pass testFetcher to Evaluate instead,
+// so the fixtures refer to a file backend whose groups.yaml does not exist.
+func loadTestConfig(t *testing.T, data string) *Config {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig(context.Background(), slog.New(slog.DiscardHandler), path, filepath.Join(dir, "cache.json"), time.Minute)
+	if err != nil {
+		t.Fatalf("LoadConfig() = %v", err)
+	}
+	return config
+}
+
+type evaluateTest struct {
+	name      string
+	principal string
+	email     string
+	sub       string
+	hd        string
+	aud       string
+	iss       string
+	// unverified email
+	unverified bool
+
+	allow  bool
+	reason Reason
+	policy string
+	rule   *int
+}
+
+func (test evaluateTest) run(t *testing.T, config *Config) {
+	t.Helper()
+	request := &Request{
+		Principal:     test.principal,
+		Email:         test.email,
+		EmailVerified: !test.unverified,
+		ClientID:      "app",
+		Issuer:        DefaultIssuer,
+		Subject:       test.sub,
+		Claims:        map[string]any{},
+	}
+	if test.aud != "" {
+		request.ClientID = test.aud
+	}
+	if test.iss != "" {
+		request.Issuer = test.iss
+	}
+	if test.hd != "" {
+		request.Claims["hd"] = test.hd
+	}
+	decision, err := Evaluate(context.Background(), slog.New(slog.DiscardHandler), Fetchers{"": testFetcher}, config, request)
+	if err != nil {
+		t.Fatalf("Evaluate() = %v", err)
+	}
+	if decision.Allow != test.allow || decision.Reason != test.reason {
+		t.Errorf("Evaluate() = %s %s, want %v %s", decision, decision.Reason, test.allow, test.reason)
+	}
+	if test.policy != "" && decision.Policy != test.policy {
+		t.Errorf("Evaluate() policy = %q, want %q", decision.Policy, test.policy)
+	}
+	if test.rule != nil && (decision.Rule == nil || *decision.Rule != *test.rule) {
+		t.Errorf("Evaluate() rule = %v, want %d", decision.Rule, *test.rule)
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	config := loadTestConfig(t, `
+google:
+  oauth:
+    client_id: app
+backend:
+  type: file
+  file:
+    path: groups.yaml
+policy:
+  root:
+    users: [admin@example.com]
+    groups: [devs@example.com]
+`)
+
+	tests := []evaluateTest{
+		{name: "user", principal: "root", email: "admin@example.com", allow: true, reason: ReasonUserMatch, policy: "root"},
+		{name: "group", principal: "root", email: "alice@example.com", allow: true, reason: ReasonGroupMatch, policy: "root"},
+		{name: "unknown user", principal: "root", email: "zed@example.com", reason: ReasonNoMatch},
+		{name: "email not verified", principal: "root", email: "admin@example.com", unverified: true, reason: ReasonEmailNotVerified},
+		{name: "other client", principal: "root", email: "admin@example.com", aud: "other", reason: ReasonAudienceMismatch},
+		{name: "unknown principal", principal: "guest", email: "admin@example.com", reason: ReasonNoPolicy},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, config)
+		})
+	}
+}
+
+func TestEvaluateDeny(t *testing.T) {
+	config := loadTestConfig(t, `
+google:
+  oauth:
+    client_id: app
+backend:
+  type: file
+  file:
+    path: groups.yaml
+policy:
+  root:
+    users: [admin@example.com, mallory@example.com]
+    groups: [devs@example.com]
+    deny_users: [mallory@example.com]
+    deny_groups: [contractors@example.com]
+`)
+
+	tests := []evaluateTest{
+		{name: "user", principal: "root", email: "admin@example.com", allow: true, reason: ReasonUserMatch},
+		{name: "group", principal: "root", email: "alice@example.com", allow: true, reason: ReasonGroupMatch},
+		{name: "deny user over user and group", principal: "root", email: "mallory@example.com", reason: ReasonDenyUserMatch},
+		{name: "deny group over group", principal: "root", email: "dave@example.com", reason: ReasonDenyGroupMatch},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, config)
+		})
+	}
+}
+
+func TestEvaluateMemberFilters(t *testing.T) {
+	config := loadTestConfig(t, `
+google:
+  oauth:
+    client_id: app
+backend:
+  type: file
+  file:
+    path: groups.yaml
+policy:
+  root:
+    groups: [devs@example.com]
+  suspended:
+    groups: [devs@example.com]
+    member_statuses: [ACTIVE, SUSPENDED]
+  groups-only:
+    groups: [devs@example.com]
+    member_types: [GROUP]
+`)
+
+	tests := []evaluateTest{
+		{name: "active member", principal: "root", email: "alice@example.com", allow: true, reason: ReasonGroupMatch},
+		{name: "suspended member", principal: "root", email: "bob@example.com", reason: ReasonNoMatch},
+		{name: "suspended member allowed by statuses", principal: "suspended", email: "bob@example.com", allow: true, reason: ReasonGroupMatch},
+		{name: "user member of other type", principal: "groups-only", email: "alice@example.com", reason: ReasonNoMatch},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, config)
+		})
+	}
+}
+
+func TestEvaluateRoles(t *testing.T) {
+	config := loadTestConfig(t, `
+google:
+  oauth:
+    client_id: app
+backend:
+  type: file
+  file:
+    path: groups.yaml
+policy:
+  owners:
+    groups:
+      - group: devs@example.com
+        roles: [OWNER]
+`)
+
+	tests := []evaluateTest{
+		{name: "role", principal: "owners", email: "carol@example.com", allow: true, reason: ReasonGroupMatch},
+		{name: "other role", principal: "owners", email: "alice@example.com", reason: ReasonNoMatch},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, config)
+		})
+	}
+}
+
+func TestEvaluateClaims(t *testing.T) {
+	config := loadTestConfig(t, `
+google:
+  oauth:
+    client_id: app
+    allowed_hosted_domains: [example.com]
+backend:
+  type: file
+  file:
+    path: groups.yaml
+policy:
+  root:
+    users: [admin@example.com]
+`)
+
+	tests := []evaluateTest{
+		{name: "issuer and hosted domain", principal: "root", email: "admin@example.com", hd: "example.com", allow: true, reason: ReasonUserMatch},
+		{name: "other issuer", principal: "root", email: "admin@example.com", hd: "example.com", iss: "https://evil.com", reason: ReasonIssuerMismatch},
+		{name: "other hosted domain", principal: "root", email: "admin@example.com", hd: "evil.com", reason: ReasonHostedDomainMismatch},
+		{name: "personal account", principal: "root", email: "admin@example.com", reason: ReasonHostedDomainMismatch},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, config)
+		})
+	}
+}
+
+func TestEvaluateUserID(t *testing.T) {
+	config := loadTestConfig(t, `
+google:
+  oauth:
+    client_id: app
+backend:
+  type: file
+  file:
+    path: groups.yaml
+policy:
+  root:
+    users: ["id:42"]
+    groups: [devs@example.com]
+  by-id:
+    groups: [devs@example.com]
+    email_fallback: false
+  deny-by-id:
+    users: ["*@example.com"]
+    deny_groups: [contractors@example.com, devs@example.com]
+    email_fallback: false
+`)
+
+	tests := []evaluateTest{
+		{name: "user by id", principal: "root", email: "renamed@example.com", sub: "42", allow: true, reason: ReasonUserMatch},
+		{name: "other user id", principal: "root", email: "zed@example.com", sub: "43", reason: ReasonNoMatch},
+		{name: "member by id", principal: "root", email: "renamed@example.com", sub: "7", allow: true, reason: ReasonGroupMatch},
+		{name: "member id over email", principal: "root", email: "carol@example.com", sub: "8", reason: ReasonNoMatch},
+		{name: "member without id by email", principal: "root", email: "alice@example.com", sub: "9", allow: true, reason: ReasonGroupMatch},
+		{name: "member without id and no email fallback", principal: "by-id", email: "alice@example.com", sub: "9", reason: ReasonNoMatch},
+		{name: "member by id and no email fallback", principal: "by-id", email: "renamed@example.com", sub: "7", allow: true, reason: ReasonGroupMatch},
+		{name: "deny member without id and no email fallback", principal: "deny-by-id", email: "dave@example.com", sub: "9", reason: ReasonDenyGroupMatch},
+		{name: "deny member by id", principal: "deny-by-id", email: "renamed@example.com", sub: "7", reason: ReasonDenyGroupMatch},
+		{name: "deny member by email with other id", principal: "deny-by-id", email: "carol@example.com", sub: "8", reason: ReasonDenyGroupMatch},
+		{name: "not a member of deny groups", principal: "deny-by-id", email: "zed@example.com", sub: "9", allow: true, reason: ReasonUserMatch},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, config)
+		})
+	}
+}
+
+func TestEvaluateConditions(t *testing.T) {
+	config := loadTestConfig(t, `
+google:
+  oauth:
+    client_id: app
+backend:
+  type: file
+  file:
+    path: groups.yaml
+policy:
+  "deploy-*":
+    users: ["*@example.com"]
+    deny_conditions: ['hd != "example.com"']
+  "regex:^ci-[0-9]+$":
+    conditions: ['email.endsWith("@ci.example.com")']
+  amr:
+    conditions: ['"mfa" in claims.amr']
+  deny-amr:
+    users: ["*@example.com"]
+    deny_conditions: ['!("mfa" in claims.amr)']
+`)
+
+	tests := []evaluateTest{
+		{name: "user without deny condition", principal: "deploy-web", email: "alice@example.com", hd: "example.com", allow: true, reason: ReasonUserMatch, policy: "deploy-*"},
+		{name: "deny condition over user", principal: "deploy-web", email: "alice@example.com", hd: "evil.com", reason: ReasonDenyConditionMatch},
+		{name: "condition", principal: "ci-12", email: "runner@ci.example.com", allow: true, reason: ReasonConditionMatch},
+		{name: "false condition", principal: "ci-12", email: "alice@example.com", reason: ReasonNoMatch},
+		{name: "condition which fails to evaluate does not allow", principal: "amr", email: "alice@example.com", reason: ReasonNoMatch},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, config)
+		})
+	}
+
+	t.Run("deny condition which fails to evaluate denies", func(t *testing.T) {
+		request := &Request{
+			Principal:     "deny-amr",
+			Email:         "alice@example.com",
+			EmailVerified: true,
+			ClientID:      "app",
+			Issuer:        DefaultIssuer,
+			Claims:        map[string]any{},
+		}
+		decision, err := Evaluate(context.Background(), slog.New(slog.DiscardHandler), Fetchers{"": testFetcher}, config, request)
+		if err == nil {
+			t.Errorf("Evaluate() = %s %s, want error", decision, decision.Reason)
+		}
+	})
+}
+
+func TestEvaluateRules(t *testing.T) {
+	config := loadTestConfig(t, `
+google:
+  oauth:
+    client_id: app
+backend:
+  type: file
+  file:
+    path: groups.yaml
+policy:
+  root:
+    users: [admin@example.com]
+    deny_users: [mallory@example.com]
+    deny_groups: [contractors@example.com]
+rules:
+  - description: contractors never get root
+    principals: [root]
+    effect: deny
+    domains: [contractor.com]
+  - description: devs get root and deploy accounts
+    principals: [root, "deploy-*"]
+    effect: allow
+    groups: [devs@example.com]
+  - description: anyone of the workspace gets the app account
+    principals: [app]
+    effect: allow
+    conditions: ['hd == "example.com"']
+  - description: nobody else gets deploy accounts
+    principals: ["deploy-*"]
+    effect: deny
+`)
+
+	rule := func(index int) *int {
+		return &index
+	}
+	tests := []evaluateTest{
+		{name: "deny rule before allow rule", principal: "root", email: "eve@contractor.com", reason: ReasonRuleDeny, rule: rule(0)},
+		{name: "allow rule", principal: "root", email: "alice@example.com", allow: true, reason: ReasonRuleAllow, rule: rule(1)},
+		{name: "deny user of policy over allow rule", principal: "root", email: "mallory@example.com", reason: ReasonDenyUserMatch},
+		{name: "deny group of policy over allow rule", principal: "root", email: "dave@example.com", reason: ReasonDenyGroupMatch},
+		{name: "policy if no rule matches", principal: "root", email: "admin@example.com", allow: true, reason: ReasonUserMatch, policy: "root"},
+		{name: "allow rule without policy", principal: "deploy-web", email: "alice@example.com", allow: true, reason: ReasonRuleAllow, rule: rule(1)},
+		{name: "suspended member is not allowed by rule", principal: "deploy-web", email: "bob@example.com", reason: ReasonRuleDeny, rule: rule(3)},
+		{name: "rule condition", principal: "app", email: "zed@example.com", hd: "example.com", allow: true, reason: ReasonRuleAllow, rule: rule(2)},
+		{name: "false rule condition", principal: "app", email: "zed@example.com", hd: "evil.com", reason: ReasonNoPolicy},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, config)
+		})
+	}
+}
+
+// staleFetcher answers like testFetcher from stale cache.
+type staleFetcher struct{}
+
+func (staleFetcher) GroupMembers(ctx context.Context, logger *slog.Logger, groupEmail string) ([]*Member, error) {
+	markStale(ctx)
+	return testFetcher.GroupMembers(ctx, logger, groupEmail)
+}
+
+func TestEvaluateStale(t *testing.T) {
+	config := loadTestConfig(t, `
+google:
+  oauth:
+    client_id: app
+backend:
+  type: file
+  file:
+    path: groups.yaml
+policy:
+  root:
+    users: [admin@example.com]
+    conditions: ['email == "runner@example.com"']
+    deny_groups: [contractors@example.com]
+`)
+
+	tests := []struct {
+		name       string
+		email      string
+		unverified bool
+		reason     Reason
+		stale      bool
+	}{
+		{name: "user after stale deny groups", email: "admin@example.com", reason: ReasonUserMatch, stale: true},
+		{name: "condition after stale deny groups", email: "runner@example.com", reason: ReasonConditionMatch, stale: true},
+		{name: "deny group from stale cache", email: "dave@example.com", reason: ReasonDenyGroupMatch, stale: true},
+		{name: "no groups consulted", email: "admin@example.com", unverified: true, reason: ReasonEmailNotVerified},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := &Request{
+				Principal:     "root",
+				Email:         test.email,
+				EmailVerified: !test.unverified,
+				ClientID:      "app",
+				Issuer:        DefaultIssuer,
+			}
+			decision, err := Evaluate(context.Background(), slog.New(slog.DiscardHandler), Fetchers{"": staleFetcher{}}, config, request)
+			if err != nil {
+				t.Fatalf("Evaluate() = %v", err)
+			}
+			if decision.Reason != test.reason || decision.Stale != test.stale {
+				t.Errorf("Evaluate() = %s stale %v, want %s stale %v", decision.Reason, decision.Stale, test.reason, test.stale)
+			}
+		})
+	}
+}